@@ -1,123 +1,702 @@
 package main
 
 import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"maps"
 	"os"
+	"os/signal"
+	"slices"
 	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
 
 	"github.com/3-shake/alert-menta/internal/ai"
 	"github.com/3-shake/alert-menta/internal/github"
+	"github.com/3-shake/alert-menta/internal/server"
 	"github.com/3-shake/alert-menta/internal/utils"
+	"golang.org/x/oauth2"
 )
 
 // Struct to hold the command-line arguments
 type Config struct {
-	repo        string
-	owner       string
-	issueNumber int
-	intent      string
-	command     string
-	configFile  string
-	ghToken     string
-	oaiKey      string
+	repo         string
+	owner        string
+	issueNumber  int
+	intent       string
+	command      string
+	configFile   string
+	orgConfig    string
+	github       githubAuth
+	oaiKey       string
+	anthropicKey string
+	azureKey     string
+	commentBody  string
+	event        bool
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "serve":
+			serve(os.Args[2:])
+			return
+		case "validate":
+			validate(os.Args[2:])
+			return
+		case "config":
+			configCommand(os.Args[2:])
+			return
+		}
+	}
+
 	cfg := &Config{}
 	flag.StringVar(&cfg.repo, "repo", "", "Repository name")
 	flag.StringVar(&cfg.owner, "owner", "", "Repository owner")
 	flag.IntVar(&cfg.issueNumber, "issue", 0, "Issue number")
 	flag.StringVar(&cfg.intent, "intent", "", "Question or intent for the 'ask' command")
 	flag.StringVar(&cfg.command, "command", "", "Commands to be executed by AI. Commands defined in the configuration file are available.")
-	flag.StringVar(&cfg.configFile, "config", "", "Configuration file")
-	flag.StringVar(&cfg.ghToken, "github-token", "", "GitHub token")
-	flag.StringVar(&cfg.oaiKey, "api-key", "", "OpenAI api key")
+	flag.StringVar(&cfg.configFile, "config", "", "Configuration file of the repository")
+	registerOrgConfig(flag.CommandLine, &cfg.orgConfig)
+	cfg.github.register(flag.CommandLine)
+	flag.StringVar(&cfg.oaiKey, "api-key", "", "OpenAI api key. Overrides ai.openai.api_key of the configuration file")
+	flag.StringVar(&cfg.anthropicKey, "anthropic-api-key", "", "Anthropic api key. Overrides ai.anthropic.api_key of the configuration file")
+	flag.StringVar(&cfg.azureKey, "azure-openai-api-key", "", "Azure OpenAI api key. Overrides ai.azure_openai.api_key of the configuration file. If neither is set, Microsoft Entra ID authentication is used")
+	flag.StringVar(&cfg.commentBody, "comment-body", "", "Comment with the slash command, e.g. '/ask What happened?'. Use '-' to read it from stdin. Replaces -command and -intent.")
+	flag.BoolVar(&cfg.event, "event", false, "Read the repository, issue number and comment from the GitHub Actions event (GITHUB_EVENT_PATH and GITHUB_REPOSITORY), and the API endpoint from GITHUB_API_URL. Flags that are set take precedence.")
 	flag.Parse()
 
-	if cfg.repo == "" || cfg.owner == "" || cfg.issueNumber == 0 || cfg.ghToken == "" || cfg.command == "" || cfg.configFile == "" {
+	logger := log.New(
+		os.Stdout, "[alert-menta main] ",
+		log.Ldate|log.Ltime|log.Llongfile|log.Lmsgprefix,
+	)
+
+	var event *github.Event
+	if cfg.event {
+		var err error
+		if event, err = github.ReadActionsEvent(); err != nil {
+			logger.Fatalf("Error reading event: %v", err)
+		}
+		applyEvent(cfg, event)
+		// Runners of a GitHub Enterprise Server point to its API
+		if apiURL := os.Getenv("GITHUB_API_URL"); cfg.github.baseURL == "" && apiURL != "" && apiURL != "https://api.github.com" {
+			cfg.github.baseURL = apiURL
+		}
+		logger.Printf("Event %s on #%d in %s/%s by @%s (%s)", event.Name, event.Number, event.Owner, event.Repo, event.Author, event.AuthorAssociation)
+		// e.g. an issues event, which has no comment to read the command from
+		if cfg.command == "" && cfg.commentBody == "" {
+			logger.Fatalf("Error: event %s has no comment; pass -command", event.Name)
+		}
+	}
+
+	if cfg.repo == "" || cfg.owner == "" || cfg.issueNumber == 0 || !cfg.github.isSet() || (cfg.command == "" && cfg.commentBody == "") {
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
 
+	// Parse the command from the comment, so that the workflow does not have to handle its quotes and line breaks
+	var options map[string]string
+	if cfg.commentBody != "" {
+		slashCommand, err := parseCommentBody(cfg.commentBody, os.Stdin)
+		if cfg.event && errors.Is(err, utils.ErrNotSlashCommand) {
+			// Not every comment is meant for alert-menta
+			logger.Println("The comment is not a slash command, nothing to do")
+			return
+		}
+		if err != nil {
+			logger.Fatalf("Error parsing comment: %v", err)
+		}
+		cfg.command, cfg.intent, options = slashCommand.Name, slashCommand.Intent, slashCommand.Options
+	}
+
+	// Stop waiting for the AI when the workflow run is canceled
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	loadedcfg, err := loadConfig(cfg.configFile, cfg.orgConfig, &cfg.github)
+	if err != nil {
+		logger.Fatalf("Error loading config: %v", err)
+	}
+
+	if event != nil && !authorAllowed(event.AuthorAssociation, loadedcfg) {
+		logger.Printf("@%s (%s) is not allowed to run commands, nothing to do", event.Author, event.AuthorAssociation)
+		return
+	}
+
+	if err := cfg.github.init(loadedcfg); err != nil {
+		logger.Fatalf("Error setting up GitHub authentication: %v", err)
+	}
+	issue, err := cfg.github.newIssue(cfg.owner, cfg.repo, cfg.issueNumber)
+	if err != nil {
+		logger.Fatalf("Error creating GitHub client: %v", err)
+	}
+	apiKeys := providerAPIKeys(map[string]string{"openai": cfg.oaiKey, "anthropic": cfg.anthropicKey, "azure_openai": cfg.azureKey}, loadedcfg)
+	req := &commandRequest{command: cfg.command, intent: cfg.intent, options: options}
+	if event != nil {
+		req.commentID = event.CommentID
+	}
+	if err := runCommand(ctx, issue, req, loadedcfg, apiKeys, logger); err != nil {
+		logger.Fatalf("Error running the /%s command: %v", cfg.command, err)
+	}
+}
+
+// Run the webhook server, which answers the commands in issue_comment webhooks until it receives SIGINT or SIGTERM
+func serve(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := fs.String("addr", ":8080", "Address to listen on")
+	configFile := fs.String("config", "", "Configuration file of the repository")
+	var orgConfig string
+	registerOrgConfig(fs, &orgConfig)
+	var auth githubAuth
+	auth.register(fs)
+	oaiKey := fs.String("api-key", "", "OpenAI api key. Overrides ai.openai.api_key of the configuration file")
+	anthropicKey := fs.String("anthropic-api-key", "", "Anthropic api key. Overrides ai.anthropic.api_key of the configuration file")
+	azureKey := fs.String("azure-openai-api-key", "", "Azure OpenAI api key. Overrides ai.azure_openai.api_key of the configuration file. If neither is set, Microsoft Entra ID authentication is used")
+	secret := fs.String("webhook-secret", os.Getenv("ALERT_MENTA_WEBHOOK_SECRET"), "Secret of the GitHub webhook. Defaults to $ALERT_MENTA_WEBHOOK_SECRET")
+	workers := fs.Int("workers", server.DefaultWorkers, "Number of commands run at the same time")
+	queueSize := fs.Int("queue-size", server.DefaultQueueSize, "Number of commands waiting for a worker. Webhooks over the limit are refused")
+	shutdownTimeout := fs.Duration("shutdown-timeout", time.Minute, "Time to wait for running commands on shutdown")
+	_ = fs.Parse(args)
+
+	if !auth.isSet() || *secret == "" {
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+
 	logger := log.New(
 		os.Stdout, "[alert-menta main] ",
 		log.Ldate|log.Ltime|log.Llongfile|log.Lmsgprefix,
 	)
-
-	loadedcfg, err := utils.NewConfig(cfg.configFile)
+	loadedcfg, err := loadConfig(*configFile, orgConfig, &auth)
 	if err != nil {
 		logger.Fatalf("Error loading config: %v", err)
 	}
+	if err := auth.init(loadedcfg); err != nil {
+		logger.Fatalf("Error setting up GitHub authentication: %v", err)
+	}
+	apiKeys := providerAPIKeys(map[string]string{"openai": *oaiKey, "anthropic": *anthropicKey, "azure_openai": *azureKey}, loadedcfg)
 
-	issue := github.NewIssue(cfg.owner, cfg.repo, cfg.issueNumber, cfg.ghToken)
-
-	// Validate command
-	err = validateCommand(cfg.command, loadedcfg)
+	srv, err := server.New(server.Options{Secret: []byte(*secret), Workers: *workers, QueueSize: *queueSize}, func(ctx context.Context, event *github.Event) error {
+		return handleEvent(ctx, event, &auth, loadedcfg, apiKeys, logger)
+	})
 	if err != nil {
-		// Get available commands for the error message
-		availableCommands := getAvailableCommands(loadedcfg)
-		usageMessage := fmt.Sprintf("**Error**: %v\n\n**Available commands:**\n", err)
+		logger.Fatalf("Error creating server: %v", err)
+	}
 
-		// Add each command with its description to the usage message
-		for cmd, description := range availableCommands {
-			usageMessage += fmt.Sprintf("- `/%s`: %s\n", cmd, description)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := srv.ListenAndServe(ctx, *addr, *shutdownTimeout); err != nil {
+		logger.Fatalf("Error serving: %v", err)
+	}
+}
+
+// Check configuration files and report every problem with its line and column, e.g. in CI before a change to the configuration is merged.
+// Each file is checked as a layer over the built-in defaults and the organization configuration.
+func validate(args []string) {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	var orgConfig string
+	registerOrgConfig(fs, &orgConfig)
+	var auth githubAuth
+	auth.register(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: alert-menta validate [flags] <config file>...")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	files := fs.Args()
+	if len(files) == 0 {
+		if orgConfig == "" {
+			fs.Usage()
+			os.Exit(2)
 		}
+		// Check the organization configuration on its own
+		files = []string{""}
+	}
 
-		// Post the usage message as a comment
-		if postErr := issue.PostComment(usageMessage); postErr != nil {
-			logger.Fatalf("Error posting error comment: %v", postErr)
+	failed := false
+	for _, file := range files {
+		sources, err := configSources(file, orgConfig, &auth)
+		if err == nil {
+			err = utils.ValidateConfigSources(sources...)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			failed = true
+			continue
 		}
+		fmt.Printf("%s: OK\n", sources[len(sources)-1].Name)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// Run the config subcommands. "config print" prints the merged configuration files as YAML,
+// with the built-in defaults if --effective is given. References such as ${ENV_VAR} are printed as they are.
+func configCommand(args []string) {
+	if len(args) == 0 || args[0] != "print" {
+		fmt.Fprintln(os.Stderr, "Usage: alert-menta config print [--effective] [-config <file>] [-org-config <file>]")
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet("config print", flag.ExitOnError)
+	effective := fs.Bool("effective", false, "Include the built-in defaults, to show the configuration that commands use")
+	configFile := fs.String("config", "", "Configuration file of the repository")
+	var orgConfig string
+	registerOrgConfig(fs, &orgConfig)
+	var auth githubAuth
+	auth.register(fs)
+	_ = fs.Parse(args[1:])
 
-		// Exit with error code
-		logger.Printf("Error validating command: %v", err)
+	sources, err := configSources(*configFile, orgConfig, &auth)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if !*effective {
+		sources = sources[1:]
+	}
+	merged, err := utils.MergeConfig(sources...)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
+	_, _ = os.Stdout.Write(merged)
+}
 
-	// Check if intent is required for this command and missing
-	needsIntent, err := commandNeedsIntent(cfg.command, loadedcfg)
+func registerOrgConfig(fs *flag.FlagSet, orgConfig *string) {
+	fs.StringVar(orgConfig, "org-config", os.Getenv("ALERT_MENTA_ORG_CONFIG"), "Configuration shared by the repositories of an organization, which the repository configuration overrides. "+
+		"A path, or a file in another repository as github:<owner>/<repo>/<path>[@<ref>]. Defaults to $ALERT_MENTA_ORG_CONFIG")
+}
+
+// Return the configuration layers in order: the built-in defaults, the organization configuration and the repository configuration.
+// The files that are not given are left out.
+func configSources(filename, orgConfig string, auth *githubAuth) ([]utils.ConfigSource, error) {
+	sources := []utils.ConfigSource{utils.DefaultConfigSource()}
+	if orgConfig != "" {
+		data, err := readOrgConfig(orgConfig, auth)
+		if err != nil {
+			return nil, fmt.Errorf("error reading organization config: %w", err)
+		}
+		sources = append(sources, utils.ConfigSource{Name: orgConfig, Data: data})
+	}
+	if filename != "" {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, fmt.Errorf("error reading config file: %w", err)
+		}
+		sources = append(sources, utils.ConfigSource{Name: filename, Data: data})
+	}
+	return sources, nil
+}
+
+// Read the organization configuration from a path, or from another repository with github:<owner>/<repo>/<path>[@<ref>]
+func readOrgConfig(orgConfig string, auth *githubAuth) ([]byte, error) {
+	ref, ok := strings.CutPrefix(orgConfig, "github:")
+	if !ok {
+		return os.ReadFile(orgConfig)
+	}
+	ref, gitRef, _ := strings.Cut(ref, "@")
+	parts := strings.SplitN(ref, "/", 3)
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return nil, fmt.Errorf("invalid reference %q, expected github:<owner>/<repo>/<path>[@<ref>]", orgConfig)
+	}
+	if !auth.isSet() {
+		return nil, fmt.Errorf("-github-token or -github-app-id is required to read %s", orgConfig)
+	}
+	// The configuration is not loaded yet, so the endpoints come from the flags
+	if err := auth.init(&utils.Config{}); err != nil {
+		return nil, err
+	}
+	repo, err := auth.newIssue(parts[0], parts[1], 0)
 	if err != nil {
-		logger.Fatalf("Error checking if intent is required: %v", err)
+		return nil, err
 	}
-	if needsIntent && cfg.intent == "" {
-		usageMessage := fmt.Sprintf("**Error**: The `/%s` command requires additional text after the command.\n\n**Usage**: `/%s [your text here]`",
-			cfg.command, cfg.command)
+	return repo.GetFile(parts[2], gitRef)
+}
 
-		// Post the usage message as a comment
-		if postErr := issue.PostComment(usageMessage); postErr != nil {
-			logger.Fatalf("Error posting error comment: %v", postErr)
+// Validate and load the configuration layers, so that mistakes are reported before any work is done
+func loadConfig(filename, orgConfig string, auth *githubAuth) (*utils.Config, error) {
+	sources, err := configSources(filename, orgConfig, auth)
+	if err != nil {
+		return nil, err
+	}
+	if err := utils.ValidateConfigSources(sources...); err != nil {
+		return nil, fmt.Errorf("invalid configuration:\n%w", err)
+	}
+	return utils.LoadConfig(sources...)
+}
+
+// Environment variables with the API key of a provider that neither a flag nor the configuration file sets
+var apiKeyEnv = map[string]string{
+	"openai":       "OPENAI_API_KEY",
+	"anthropic":    "ANTHROPIC_API_KEY",
+	"azure_openai": "AZURE_OPENAI_API_KEY",
+}
+
+// Complete the API keys given as flags with the keys of the configuration file, and then with the environment.
+// Keys in the file are references to the environment or to files, so they do not show in the process list.
+func providerAPIKeys(flagKeys map[string]string, cfg *utils.Config) map[string]string {
+	configKeys := map[string]string{
+		"openai":       cfg.Ai.OpenAI.APIKey,
+		"anthropic":    cfg.Ai.Anthropic.APIKey,
+		"azure_openai": cfg.Ai.AzureOpenAI.APIKey,
+	}
+	apiKeys := make(map[string]string, len(configKeys))
+	for provider, key := range configKeys {
+		apiKeys[provider] = cmp.Or(flagKeys[provider], key, os.Getenv(apiKeyEnv[provider]))
+	}
+	return apiKeys
+}
+
+// Answer the slash command in the comment of a webhook event. Comments that are not commands,
+// and commands by authors who are not allowed, are ignored.
+func handleEvent(ctx context.Context, event *github.Event, auth *githubAuth, cfg *utils.Config, apiKeys map[string]string, logger *log.Logger) error {
+	slashCommand, err := utils.ParseSlashCommand(event.CommentBody)
+	if errors.Is(err, utils.ErrNotSlashCommand) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("parsing comment: %w", err)
+	}
+	if !authorAllowed(event.AuthorAssociation, cfg) {
+		logger.Printf("@%s (%s) is not allowed to run commands on %s/%s#%d", event.Author, event.AuthorAssociation, event.Owner, event.Repo, event.Number)
+		return nil
+	}
+
+	issue, err := auth.newIssue(event.Owner, event.Repo, event.Number)
+	if err != nil {
+		return err
+	}
+	req := &commandRequest{command: slashCommand.Name, intent: slashCommand.Intent, options: slashCommand.Options, commentID: event.CommentID}
+	return runCommand(ctx, issue, req, cfg, apiKeys, logger)
+}
+
+// GitHub credentials: a token, or a GitHub App whose installation tokens are minted as needed.
+// The endpoints of a GitHub Enterprise Server can be set with flags or in the configuration file.
+type githubAuth struct {
+	baseURL        string
+	uploadURL      string
+	token          string
+	appID          int64
+	installationID int64
+	privateKeyFile string
+	app            *github.App
+}
+
+func (a *githubAuth) register(fs *flag.FlagSet) {
+	fs.StringVar(&a.baseURL, "github-base-url", "", "API endpoint of a GitHub Enterprise Server, e.g. https://ghes.example.com/api/v3/. Overrides github.base_url")
+	fs.StringVar(&a.uploadURL, "github-upload-url", "", "Upload endpoint of a GitHub Enterprise Server. Overrides github.upload_url")
+	fs.StringVar(&a.token, "github-token", "", "GitHub token")
+	fs.Int64Var(&a.appID, "github-app-id", 0, "GitHub App ID, to authenticate as a GitHub App instead of with -github-token")
+	fs.Int64Var(&a.installationID, "github-app-installation-id", 0, "GitHub App installation ID. If 0, the installation on the repository is looked up")
+	fs.StringVar(&a.privateKeyFile, "github-app-private-key", "", "Path to the private key (PEM) of the GitHub App. If empty, $GITHUB_APP_PRIVATE_KEY is used")
+}
+
+// Report whether a token or a GitHub App is given
+func (a *githubAuth) isSet() bool {
+	return a.token != "" || a.appID != 0
+}
+
+// Take the endpoints that are not set with flags from the configuration, and load the private key of the GitHub App, if one is used
+func (a *githubAuth) init(cfg *utils.Config) error {
+	if a.baseURL == "" {
+		a.baseURL = cfg.GitHub.BaseURL
+	}
+	if a.uploadURL == "" {
+		a.uploadURL = cfg.GitHub.UploadURL
+	}
+	if a.appID == 0 {
+		return nil
+	}
+	if a.token != "" {
+		return fmt.Errorf("-github-token and -github-app-id cannot be used together")
+	}
+	key := []byte(os.Getenv("GITHUB_APP_PRIVATE_KEY"))
+	if a.privateKeyFile != "" {
+		var err error
+		if key, err = os.ReadFile(a.privateKeyFile); err != nil {
+			return fmt.Errorf("reading GitHub App private key: %w", err)
 		}
+	}
+	app, err := github.NewApp(a.appID, key, a.installationID, a.baseURL)
+	if err != nil {
+		return err
+	}
+	a.app = app
+	return nil
+}
 
-		// Exit with error code
-		logger.Printf("Error: intent required for command %s", cfg.command)
-		os.Exit(1)
+func (a *githubAuth) newIssue(owner, repo string, issueNumber int) (*github.GitHubIssue, error) {
+	ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: a.token})
+	if a.app != nil {
+		ts = a.app.TokenSource(owner, repo)
 	}
+	issue, err := github.NewEnterpriseIssue(owner, repo, issueNumber, ts, a.baseURL, a.uploadURL)
+	if err != nil || a.app == nil {
+		return issue, err
+	}
+	// Installation tokens cannot look up the user that posts the comments
+	login, err := a.app.Login(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	issue.SetLogin(login)
+	return issue, nil
+}
+
+// A command to answer on an Issue
+type commandRequest struct {
+	command string
+	intent  string
+	options map[string]string
+	// Comment with the command, which gets reactions. 0 if there is none, e.g. with -command.
+	commentID int64
+}
+
+// Answer the command on the Issue: build the prompt, get the response from the AI and post it as a comment.
+// If the command is invalid, a usage message is posted instead and an error is returned.
+// It is shared by the CLI and the webhook server.
+func runCommand(ctx context.Context, issue *github.GitHubIssue, req *commandRequest, cfg *utils.Config, apiKeys map[string]string, logger *log.Logger) (err error) {
+	// Show that the command was picked up, and then whether it succeeded
+	if req.commentID != 0 && !cfg.GitHub.NoReactions {
+		react(issue, req.commentID, github.ReactionEyes, logger)
+		defer func() {
+			if err != nil {
+				react(issue, req.commentID, github.ReactionConfused, logger)
+			} else {
+				react(issue, req.commentID, github.ReactionRocket, logger)
+			}
+		}()
+	}
+
+	if usageMessage, err := checkCommand(req, cfg); err != nil {
+		// Post the usage message as a comment
+		if usageMessage != "" {
+			if postErr := issue.PostComment(usageMessage); postErr != nil {
+				return fmt.Errorf("posting error comment: %w", postErr)
+			}
+		}
+		return err
+	}
+	cfg = commandConfig(req.command, cfg)
 
-	userPrompt, imgs, err := constructUserPrompt(cfg.ghToken, issue, loadedcfg, logger)
+	budget := inputTokenBudget(req.command, req.intent+formatOptions(req.options), cfg)
+	userPrompt, data, imgs, err := constructUserPrompt(issue, req, cfg, budget, logger)
 	if err != nil {
-		logger.Fatalf("Erro constructing userPrompt: %v", err)
+		return fmt.Errorf("constructing user prompt: %w", err)
 	}
 
-	prompt, err := constructPrompt(cfg.command, cfg.intent, userPrompt, imgs, loadedcfg, logger)
+	prompt, err := constructPrompt(req.command, data, userPrompt, imgs, cfg, logger)
 	if err != nil {
-		logger.Fatalf("Error constructing prompt: %v", err)
+		return fmt.Errorf("constructing prompt: %w", err)
+	}
+
+	// The placeholder is posted once the prompt is built, so that it is not part of the thread.
+	// Sticky commands update their previous comment instead of a placeholder.
+	var placeholderID int64
+	if cfg.GitHub.Placeholder && !cfg.Ai.Commands[req.command].Sticky {
+		placeholder, createErr := issue.CreateComment(fmt.Sprintf("Working on `/%s`…", req.command))
+		if createErr != nil {
+			return fmt.Errorf("creating placeholder comment: %w", createErr)
+		}
+		placeholderID = placeholder.GetID()
+		defer func() {
+			if err == nil {
+				return
+			}
+			// The details are in the logs, which may be less public than the Issue
+			if editErr := issue.EditComment(placeholderID, fmt.Sprintf("**Error**: `/%s` failed. See the logs for details.", req.command)); editErr != nil {
+				logger.Printf("Error updating the placeholder comment: %v", editErr)
+			}
+		}()
 	}
 
-	aic, err := getAIClient(cfg.oaiKey, loadedcfg, logger)
+	aic, err := getAIClient(ctx, apiKeys, cfg, logger)
 	if err != nil {
-		logger.Fatalf("Error getting AI client: %v", err)
+		return fmt.Errorf("getting AI client: %w", err)
 	}
 
-	comment, err := aic.GetResponse(prompt)
+	comment, err := getResponse(ctx, aic, prompt, cfg.Ai.Timeout)
 	if err != nil {
-		logger.Fatalf("Error getting Response: %v", err)
+		return fmt.Errorf("getting response: %w", err)
 	}
 	logger.Println("Response:", comment)
+	if strings.TrimSpace(comment) == "" {
+		return fmt.Errorf("getting response: the AI returned an empty response")
+	}
+
+	// The first part of a long response takes the place of the comment, and the rest follows in new comments
+	chunks := splitResponse(comment, logger)
+	if cfg.Ai.Commands[req.command].Sticky {
+		return postStickyComment(issue, req.command, chunks, logger)
+	}
+	if placeholderID != 0 {
+		if err := issue.EditComment(placeholderID, chunks[0]); err != nil {
+			return fmt.Errorf("replacing the placeholder comment: %w", err)
+		}
+	} else if err := issue.PostComment(chunks[0]); err != nil {
+		return fmt.Errorf("creating comment: %w", err)
+	}
+	for i, chunk := range chunks[1:] {
+		if err := issue.PostComment(chunk); err != nil {
+			return fmt.Errorf("creating comment %d of %d: %w", i+2, len(chunks), err)
+		}
+	}
+	return nil
+}
+
+// Room left in each comment for the part number and the marker of sticky comments
+const commentOverhead = 100
+
+// Split a response over the size limit of GitHub comments into numbered parts, without cutting code blocks or tables
+func splitResponse(response string, logger *log.Logger) []string {
+	chunks := utils.SplitMarkdown(response, github.MaxCommentLength-commentOverhead)
+	if len(chunks) == 1 {
+		return chunks
+	}
+	logger.Printf("The response of %d characters is over the size limit of GitHub comments, posting it in %d comments",
+		utf8.RuneCountInString(response), len(chunks))
+	for i := range chunks {
+		chunks[i] += fmt.Sprintf("\n\n_(%d/%d)_", i+1, len(chunks))
+	}
+	return chunks
+}
+
+// React to the comment with the command. Failures are only logged, since the command can still be answered.
+func react(issue *github.GitHubIssue, commentID int64, content string, logger *log.Logger) {
+	if err := issue.AddReaction(commentID, content); err != nil {
+		logger.Printf("Error reacting to comment %d: %v", commentID, err)
+	}
+}
+
+// Sticky comments start with a hidden marker with the command name, and end with the previous versions in a collapsed section
+const (
+	stickyHistoryStart = "\n\n<details>\n<summary>Previous versions</summary>\n\n<!-- alert-menta:history -->\n"
+	stickyHistoryEnd   = "\n</details>\n"
+	stickyVersionSep   = "\n<!-- alert-menta:version -->\n"
+	// Number of previous versions kept in the history, so that the comment does not grow without limit
+	maxStickyVersions = 5
+)
+
+// Get the marker that identifies the sticky comment of a command
+func stickyMarker(command string) string {
+	return fmt.Sprintf("<!-- alert-menta:%s -->\n", command)
+}
+
+// Get the marker that identifies part n, from 2, of a sticky response that is split over several comments
+func stickyPartMarker(command string, n int) string {
+	return fmt.Sprintf("<!-- alert-menta:%s:part-%d -->\n", command, n)
+}
+
+// Post the parts of the response as the sticky comments of the command. If the command already has a comment, it is updated
+// in place and its previous response is moved to the history. The continuation parts of the previous response are replaced,
+// and the ones the new response does not need are deleted.
+func postStickyComment(issue *github.GitHubIssue, command string, chunks []string, logger *log.Logger) error {
+	marker := stickyMarker(command)
+	previous, err := issue.FindComment(marker)
+	if err != nil {
+		return fmt.Errorf("finding the previous response: %w", err)
+	}
+	if previous == nil {
+		if err := issue.PostComment(marker + chunks[0]); err != nil {
+			return fmt.Errorf("creating comment: %w", err)
+		}
+	} else {
+		logger.Printf("Updating the previous response to /%s (comment %d)", command, previous.GetID())
+		if err := issue.EditComment(previous.GetID(), updateStickyBody(marker, previous.GetBody(), previous.GetUpdatedAt(), chunks[0])); err != nil {
+			return fmt.Errorf("updating comment: %w", err)
+		}
+	}
+
+	for n := 2; ; n++ {
+		partMarker := stickyPartMarker(command, n)
+		part, err := issue.FindComment(partMarker)
+		if err != nil {
+			return fmt.Errorf("finding part %d of the previous response: %w", n, err)
+		}
+		switch {
+		case n <= len(chunks) && part == nil:
+			if err := issue.PostComment(partMarker + chunks[n-1]); err != nil {
+				return fmt.Errorf("creating comment %d of %d: %w", n, len(chunks), err)
+			}
+		case n <= len(chunks):
+			if err := issue.EditComment(part.GetID(), partMarker+chunks[n-1]); err != nil {
+				return fmt.Errorf("updating comment %d of %d: %w", n, len(chunks), err)
+			}
+		case part != nil:
+			if err := issue.DeleteComment(part.GetID()); err != nil {
+				return fmt.Errorf("deleting part %d of the previous response: %w", n, err)
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+// Get the new body of a sticky comment: the response, followed by the previous response, written at previousAt, and the older versions.
+// The oldest versions are dropped to keep the body within the size limit of GitHub comments.
+func updateStickyBody(marker, previousBody string, previousAt time.Time, response string) string {
+	current, history, _ := strings.Cut(strings.TrimPrefix(previousBody, marker), stickyHistoryStart)
+	versions := []string{fmt.Sprintf("**%s**\n\n%s", previousAt.UTC().Format("2006-01-02 15:04 UTC"), strings.TrimSpace(current))}
+	if history = strings.TrimSuffix(history, stickyHistoryEnd); history != "" {
+		versions = append(versions, strings.Split(history, stickyVersionSep)...)
+	}
+	if len(versions) > maxStickyVersions {
+		versions = versions[:maxStickyVersions]
+	}
+	for ; len(versions) > 0; versions = versions[:len(versions)-1] {
+		body := marker + response + stickyHistoryStart + strings.Join(versions, stickyVersionSep) + stickyHistoryEnd
+		if utf8.RuneCountInString(body) <= github.MaxCommentLength {
+			return body
+		}
+	}
+	return marker + response
+}
+
+// Remove the previous versions from a sticky comment, so that they are not repeated in the prompt
+func withoutStickyHistory(body string) string {
+	current, _, _ := strings.Cut(body, stickyHistoryStart)
+	return current
+}
+
+// Check the command, its intent and options. If they are invalid, the usage message to post is returned with the error.
+func checkCommand(req *commandRequest, cfg *utils.Config) (string, error) {
+	// Validate command
+	if err := validateCommand(req.command, cfg); err != nil {
+		// Get available commands for the error message
+		availableCommands := getAvailableCommands(cfg)
+		usageMessage := fmt.Sprintf("**Error**: %v\n\n**Available commands:**\n", err)
+
+		// Add each command with its description to the usage message
+		for cmd, description := range availableCommands {
+			usageMessage += fmt.Sprintf("- `/%s`: %s\n", cmd, description)
+		}
+		return usageMessage, fmt.Errorf("validating command: %w", err)
+	}
 
-	if err := issue.PostComment(comment); err != nil {
-		logger.Fatalf("Error creating comment: %v", err)
+	// Check if intent is required for this command and missing
+	needsIntent, err := commandNeedsIntent(req.command, cfg)
+	if err != nil {
+		return "", fmt.Errorf("checking if intent is required: %w", err)
 	}
+	if needsIntent && req.intent == "" {
+		usageMessage := fmt.Sprintf("**Error**: The `/%s` command requires additional text after the command.\n\n**Usage**: `/%s [your text here]`",
+			req.command, req.command)
+		return usageMessage, fmt.Errorf("intent required for command %s", req.command)
+	}
+
+	// Validate options
+	if err := validateOptions(req.command, req.options, cfg); err != nil {
+		return fmt.Sprintf("**Error**: %v\n\n%s", err, optionsUsage(req.command, cfg)), fmt.Errorf("validating options: %w", err)
+	}
+	return "", nil
 }
 
 // Validate the provided command
@@ -144,6 +723,81 @@ func commandNeedsIntent(command string, cfg *utils.Config) (bool, error) {
 	return cmd.RequireIntent, nil
 }
 
+// Fill the arguments that are not set with flags from the GitHub Actions event
+func applyEvent(cfg *Config, event *github.Event) {
+	if cfg.owner == "" {
+		cfg.owner = event.Owner
+	}
+	if cfg.repo == "" {
+		cfg.repo = event.Repo
+	}
+	if cfg.issueNumber == 0 {
+		cfg.issueNumber = event.Number
+	}
+	// An explicit -command, e.g. for issues events, is used instead of the comment
+	if cfg.commentBody == "" && cfg.command == "" {
+		cfg.commentBody = event.CommentBody
+	}
+}
+
+// Check whether the author association of the event is allowed to run commands
+func authorAllowed(association string, cfg *utils.Config) bool {
+	allowed := cfg.GitHub.AllowedAssociations
+	if len(allowed) == 0 {
+		allowed = utils.DefaultAllowedAssociations
+	}
+	return slices.ContainsFunc(allowed, func(a string) bool { return strings.EqualFold(a, association) })
+}
+
+// Read the comment body, from stdin if it is "-", and parse the slash command in it
+func parseCommentBody(commentBody string, stdin io.Reader) (*utils.SlashCommand, error) {
+	if commentBody == "-" {
+		data, err := io.ReadAll(stdin)
+		if err != nil {
+			return nil, fmt.Errorf("reading the comment from stdin: %w", err)
+		}
+		commentBody = string(data)
+	}
+	return utils.ParseSlashCommand(commentBody)
+}
+
+// Validate the options given to the command. Only the options defined for the command are allowed.
+func validateOptions(command string, options map[string]string, cfg *utils.Config) error {
+	for key := range options {
+		if _, ok := cfg.Ai.Commands[command].Options[key]; !ok {
+			return fmt.Errorf("unknown option --%s for the /%s command", key, command)
+		}
+	}
+	return nil
+}
+
+// Get the usage message that lists the options of the command
+func optionsUsage(command string, cfg *utils.Config) string {
+	commandOptions := cfg.Ai.Commands[command].Options
+	if len(commandOptions) == 0 {
+		return fmt.Sprintf("The `/%s` command has no options.", command)
+	}
+	keys := slices.Sorted(maps.Keys(commandOptions))
+	usage := fmt.Sprintf("**Options of `/%s`:**\n", command)
+	for _, key := range keys {
+		usage += fmt.Sprintf("- `--%s=...`: %s\n", key, commandOptions[key])
+	}
+	return usage
+}
+
+// Format the options for the system prompt, sorted by key so that the prompt is stable
+func formatOptions(options map[string]string) string {
+	if len(options) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteString("Options:\n")
+	for _, key := range slices.Sorted(maps.Keys(options)) {
+		sb.WriteString(fmt.Sprintf("- %s: %s\n", key, options[key]))
+	}
+	return sb.String()
+}
+
 // Get available commands with descriptions for usage message
 func getAvailableCommands(cfg *utils.Config) map[string]string {
 	commands := make(map[string]string)
@@ -153,92 +807,589 @@ func getAvailableCommands(cfg *utils.Config) map[string]string {
 	return commands
 }
 
-// Construct user prompt from issue
-func constructUserPrompt(ghToken string, issue *github.GitHubIssue, cfg *utils.Config, logger *log.Logger) (string, []ai.Image, error) {
-	var images []ai.Image
+// Get the number of tokens available for the user prompt, which is what remains of ai.max_input_tokens after the system prompt.
+// 0 means no limit.
+func inputTokenBudget(command, intent string, cfg *utils.Config) int {
+	if cfg.Ai.MaxInputTokens <= 0 {
+		return 0
+	}
+	systemPrompt := cfg.Ai.Commands[command].SystemPrompt + intent
+	// Keep the budget positive so that it is still enforced when the system prompt alone is over the limit
+	return max(cfg.Ai.MaxInputTokens-ai.EstimateTokens(budgetModel(cfg), systemPrompt), 1)
+}
 
-	title, err := issue.GetTitle()
-	if err != nil {
-		return "", nil, fmt.Errorf("getting title: %w", err)
+// Get the model used to estimate tokens. With fallback providers, it is the model with the highest estimate,
+// so that the prompt fits whichever provider answers.
+func budgetModel(cfg *utils.Config) string {
+	models := []string{getModelName(cfg.Ai.Provider, cfg)}
+	for _, provider := range cfg.Ai.FallbackProviders {
+		models = append(models, getModelName(provider, cfg))
 	}
+	return ai.MostTokensModel(models)
+}
 
-	body, err := issue.GetBody()
-	if err != nil {
-		return "", nil, fmt.Errorf("getting body: %w", err)
+// Get the model name of the provider, used to estimate tokens
+func getModelName(provider string, cfg *utils.Config) string {
+	switch provider {
+	case "openai":
+		return cfg.Ai.OpenAI.Model
+	case "vertexai":
+		return cfg.Ai.VertexAI.Model
+	case "anthropic":
+		return cfg.Ai.Anthropic.Model
+	case "azure_openai":
+		return cfg.Ai.AzureOpenAI.Deployment
+	default:
+		return ""
 	}
+}
 
-	var userPrompt strings.Builder
-	userPrompt.WriteString("Title:" + *title + "\n")
-	userPrompt.WriteString("Body:" + *body + "\n")
-	urls := utils.ExtractImageURLs(*body)
-	for _, url := range urls {
-		imgData, ext, err := utils.DownloadImage(url, ghToken)
+// imageCollector downloads the images in the issue, deduplicating them by URL and content hash
+type imageCollector struct {
+	ghToken  string
+	opts     utils.ImageOptions
+	maxCount int
+	images   []ai.Image
+	// Image number (1-based) of each downloaded URL and content hash
+	byURL  map[string]int
+	byHash map[[sha256.Size]byte]int
+	logger *log.Logger
+}
+
+// enterpriseHost is the host name of the GitHub Enterprise Server, whose images are allowed and get the token unless hosts are configured
+func newImageCollector(ghToken string, cfg utils.Images, enterpriseHost string, logger *log.Logger) *imageCollector {
+	// Unset limits use the defaults
+	opts := utils.DefaultImageOptions()
+	if enterpriseHost != "" {
+		ghesHosts := []string{enterpriseHost, "*." + enterpriseHost}
+		opts.AllowedHosts = append(slices.Clone(opts.AllowedHosts), ghesHosts...)
+		opts.TokenHosts = append(slices.Clone(opts.TokenHosts), ghesHosts...)
+	}
+	if cfg.MaxBytes > 0 {
+		opts.MaxBytes = cfg.MaxBytes
+	}
+	if len(cfg.AllowedTypes) > 0 {
+		opts.AllowedTypes = cfg.AllowedTypes
+	}
+	if len(cfg.AllowedHosts) > 0 {
+		opts.AllowedHosts = cfg.AllowedHosts
+	}
+	if len(cfg.TokenHosts) > 0 {
+		opts.TokenHosts = cfg.TokenHosts
+	}
+	opts.AllowPrivateNetworks = cfg.AllowPrivateNetworks
+	maxCount := utils.DefaultMaxImages
+	if cfg.MaxCount > 0 {
+		maxCount = cfg.MaxCount
+	}
+
+	return &imageCollector{
+		ghToken:  ghToken,
+		opts:     opts,
+		maxCount: maxCount,
+		byURL:    make(map[string]int),
+		byHash:   make(map[[sha256.Size]byte]int),
+		logger:   logger,
+	}
+}
+
+// collect downloads the images in body, which is described by source (e.g. "the comment by @user"),
+// and returns a note that tells the model which images belong to body, or "" if it has none.
+func (c *imageCollector) collect(body, source string) (string, error) {
+	urls := utils.ExtractImageURLs(body)
+	var refs []string
+	for i, url := range urls {
+		if n, ok := c.byURL[url]; ok {
+			refs = appendRef(refs, n)
+			continue
+		}
+
+		if len(c.images) >= c.maxCount {
+			c.logger.Printf("Skipping %s, the prompt already has %d images", url, c.maxCount)
+			continue
+		}
+
+		imgData, ext, err := utils.DownloadImage(url, c.ghToken, c.opts)
+		if errors.Is(err, utils.ErrImageRejected) {
+			c.logger.Printf("Skipping %s: %v", url, err)
+			continue
+		}
 		if err != nil {
-			return "", nil, fmt.Errorf("downloading image: %w", err)
+			return "", fmt.Errorf("downloading image: %w", err)
+		}
+		hash := sha256.Sum256(imgData)
+		if n, ok := c.byHash[hash]; ok {
+			c.logger.Printf("Skipping %s, same as Image %d", url, n)
+			c.byURL[url] = n
+			refs = appendRef(refs, n)
+			continue
+		}
+
+		// Downscale here, as not every provider encodes images with utils.ImageToBase64
+		if imgData, err = utils.DownscaleImage(imgData, ext, utils.MaxImageDimension); err != nil {
+			c.logger.Printf("Skipping %s: %v", url, err)
+			continue
 		}
-		images = append(images, ai.Image{Data: imgData, Extension: ext})
+
+		n := len(c.images) + 1
+		label := fmt.Sprintf("Image %d: from %s (image %d of %d)", n, source, i+1, len(urls))
+		c.images = append(c.images, ai.Image{Data: imgData, Extension: ext, Label: label})
+		c.byURL[url] = n
+		c.byHash[hash] = n
+		refs = appendRef(refs, n)
+	}
+
+	if len(refs) == 0 {
+		return "", nil
+	}
+	return "[Attached images: " + strings.Join(refs, ", ") + "]\n", nil
+}
+
+// appendRef adds a reference to image n, unless refs already has one, as a body may contain the same image more than once
+func appendRef(refs []string, n int) []string {
+	ref := fmt.Sprintf("Image %d", n)
+	if slices.Contains(refs, ref) {
+		return refs
+	}
+	return append(refs, ref)
+}
+
+// Get the longest note that imageCollector.collect can add for the images in body, so that room is reserved for it
+func imageNotePlaceholder(body string, maxCount int) string {
+	urls := utils.ExtractImageURLs(body)
+	if len(urls) == 0 {
+		return ""
+	}
+	// Each image is referenced once, and there are at most maxCount images
+	refs := make([]string, min(len(urls), maxCount))
+	for i := range refs {
+		refs[i] = fmt.Sprintf("Image %d", maxCount)
+	}
+	return "[Attached images: " + strings.Join(refs, ", ") + "]\n"
+}
+
+// A comment in the thread: a comment on the Issue, or a review comment on a pull request
+type threadComment struct {
+	author string
+	body   string
+	// File of a review comment, "" for other comments
+	path string
+	// Line of the comment in the prompt
+	line string
+	// Where the comment comes from, used in the labels of its images
+	source    string
+	createdAt time.Time
+}
+
+// Construct user prompt from issue. Pull requests also get their changed files, commits, diff and review comments.
+// If the issue does not fit in budget tokens, the oldest comments are dropped. If the command has a user_template,
+// the prompt is rendered from it. The data for the templates of the command is returned with the prompt.
+func constructUserPrompt(issue *github.GitHubIssue, req *commandRequest, cfg *utils.Config, budget int, logger *log.Logger) (string, *utils.PromptData, []ai.Image, error) {
+	gi, err := issue.GetIssue()
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("getting issue: %w", err)
+	}
+	title, body := gi.GetTitle(), gi.GetBody()
+
+	// Room is reserved for the notes about attached images. The images themselves are not counted.
+	// Images are downloaded with the same token as the API, e.g. the installation token of a GitHub App
+	ghToken, err := issue.Token()
+	if err != nil {
+		return "", nil, nil, err
+	}
+	images := newImageCollector(ghToken, cfg.Ai.Images, issue.EnterpriseHost(), logger)
+	model := budgetModel(cfg)
+	bodyNote := imageNotePlaceholder(body, images.maxCount)
+	head := "Title:" + title + "\n" + "Body:" + body + "\n"
+	if headBudget := budget - ai.EstimateTokens(model, bodyNote); budget > 0 && ai.EstimateTokens(model, head) > headBudget {
+		head = ai.TruncateText(model, head, max(headBudget, 1)) + "\n"
+		logger.Printf("Truncated the issue body to fit max_input_tokens (%d tokens)", budget)
 	}
 
-	comments, err := issue.GetComments()
+	comments, err := issue.GetCommentsWithOptions(github.CommentOptions{
+		Limit:      cfg.GitHub.Comments.Limit,
+		MostRecent: cfg.GitHub.Comments.MostRecent,
+	})
 	if err != nil {
-		return "", nil, fmt.Errorf("getting comments: %w", err)
+		return "", nil, nil, fmt.Errorf("getting comments: %w", err)
 	}
 
+	// Previous responses and placeholders are left out
+	self, err := issue.Login()
+	if err != nil {
+		return "", nil, nil, err
+	}
+	var thread []threadComment
 	for _, v := range comments {
-		if *v.User.Login == "github-actions[bot]" {
+		if isOwnComment(v.GetUser().GetLogin(), self) {
 			continue
 		}
 		if cfg.System.Debug.LogLevel == "debug" {
 			logger.Printf("%s: %s", *v.User.Login, *v.Body)
 		}
-		userPrompt.WriteString(*v.User.Login + ":" + *v.Body + "\n")
+		body := withoutStickyHistory(v.GetBody())
+		thread = append(thread, threadComment{
+			author:    v.GetUser().GetLogin(),
+			body:      body,
+			line:      v.GetUser().GetLogin() + ":" + body + "\n",
+			source:    "a comment by @" + v.GetUser().GetLogin(),
+			createdAt: v.GetCreatedAt(),
+		})
+	}
 
-		urls := utils.ExtractImageURLs(*body)
-		for _, url := range urls {
-			imgData, ext, err := utils.DownloadImage(url, ghToken)
-			if err != nil {
-				return "", nil, fmt.Errorf("downloading image: %w", err)
+	// The diff comes after the title and body, and is cut before the comments are dropped
+	var prContext string
+	if gi.IsPullRequest() {
+		pr, err := issue.GetPullRequest(maxDiffBytes(cfg.GitHub.PullRequests))
+		if err != nil {
+			return "", nil, nil, fmt.Errorf("getting pull request: %w", err)
+		}
+		prContext = formatPullRequest(pr)
+		if prBudget := budget - ai.EstimateTokens(model, head+bodyNote); budget > 0 && ai.EstimateTokens(model, prContext) > prBudget {
+			prContext = ai.TruncateText(model, prContext, prBudget)
+			if prContext != "" {
+				prContext += "\n"
 			}
-			images = append(images, ai.Image{Data: imgData, Extension: ext})
+			logger.Printf("Truncated the pull request diff to fit max_input_tokens (%d tokens)", budget)
 		}
+		thread = append(thread, reviewComments(pr, self)...)
+		// Review comments are interleaved with the comments on the pull request
+		slices.SortStableFunc(thread, func(a, b threadComment) int { return a.createdAt.Compare(b.createdAt) })
+	}
+
+	// Comment lines with room for their image notes, used to decide which comments fit
+	fitLines := make([]string, len(thread))
+	for i, c := range thread {
+		fitLines[i] = c.line + imageNotePlaceholder(c.body, images.maxCount)
+	}
+
+	// Keep the title, body and newest comments, and drop the comments in the middle of the thread
+	dropped := ai.FitComments(model, budget, head+bodyNote+prContext, fitLines)
+
+	labels := make([]string, len(gi.Labels))
+	for i, label := range gi.Labels {
+		labels[i] = label.GetName()
+	}
+	data := &utils.PromptData{
+		Issue: utils.PromptIssue{
+			Number: gi.GetNumber(),
+			Title:  title,
+			Author: gi.GetUser().GetLogin(),
+			Labels: labels,
+			State:  gi.GetState(),
+			URL:    gi.GetHTMLURL(),
+		},
+		OmittedComments: dropped,
+		PullRequest:     prContext,
+		Intent:          req.intent,
+		Options:         req.options,
+		Command:         req.command,
+		Repo:            issue.Repository(),
+		Now:             time.Now(),
+	}
+
+	// Images are collected only from the body and the comments that are kept
+	var userPrompt strings.Builder
+	userPrompt.WriteString(head)
+	note, err := images.collect(body, "the issue body by @"+gi.GetUser().GetLogin())
+	if err != nil {
+		return "", nil, nil, err
+	}
+	data.Issue.Body = body + note
+	userPrompt.WriteString(note)
+	userPrompt.WriteString(prContext)
+
+	if dropped > 0 {
+		logger.Printf("Dropped the %d oldest of %d comments to fit max_input_tokens (%d tokens)", dropped, len(thread), budget)
+		if cfg.System.Debug.LogLevel == "debug" {
+			for _, c := range thread[:dropped] {
+				logger.Printf("Dropped: %s", c.line)
+			}
+		}
+		userPrompt.WriteString(fmt.Sprintf("[%d earlier comments were omitted because the thread is too long]\n", dropped))
+	}
+	for _, c := range thread[dropped:] {
+		userPrompt.WriteString(c.line)
+		note, err := images.collect(c.body, c.source)
+		if err != nil {
+			return "", nil, nil, err
+		}
+		userPrompt.WriteString(note)
+		data.Comments = append(data.Comments, utils.PromptComment{Author: c.author, Body: c.body + note, Path: c.path, CreatedAt: c.createdAt})
+	}
+
+	userTemplate := cfg.Ai.Commands[req.command].UserTemplate
+	if userTemplate == "" {
+		return userPrompt.String(), data, images.images, nil
+	}
+	rendered, err := utils.RenderPrompt("user_template", userTemplate, data)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	// The template decides what goes in the prompt, so the limit can only be enforced on the result
+	if budget > 0 && ai.EstimateTokens(model, rendered) > budget {
+		rendered = ai.TruncateText(model, rendered, budget)
+		logger.Printf("Truncated the prompt of the user_template to fit max_input_tokens (%d tokens)", budget)
 	}
-	return userPrompt.String(), images, nil
+	return rendered, data, images.images, nil
 }
 
-// Construct AI prompt
-func constructPrompt(command, intent, userPrompt string, imgs []ai.Image, cfg *utils.Config, logger *log.Logger) (*ai.Prompt, error) {
-	var systemPrompt string
-	if cfg.Ai.Commands[command].RequireIntent {
-		if intent == "" {
-			return nil, fmt.Errorf("intent is required for '%s' command", command)
+// Get the size of the pull request diff to include in the prompt, 0 meaning none
+func maxDiffBytes(cfg utils.PullRequests) int {
+	switch {
+	case cfg.MaxDiffBytes < 0:
+		return 0
+	case cfg.MaxDiffBytes == 0:
+		return utils.DefaultMaxDiffBytes
+	default:
+		return cfg.MaxDiffBytes
+	}
+}
+
+// Format the changed files, commit messages and diff of a pull request for the user prompt
+func formatPullRequest(pr *github.PullRequest) string {
+	var sb strings.Builder
+	additions, deletions := 0, 0
+	for _, f := range pr.Files {
+		additions += f.GetAdditions()
+		deletions += f.GetDeletions()
+	}
+	sb.WriteString(fmt.Sprintf("Changed files (%d, +%d -%d):\n", len(pr.Files), additions, deletions))
+	for _, f := range pr.Files {
+		sb.WriteString(fmt.Sprintf("- %s %s (+%d -%d)\n", f.GetStatus(), f.GetFilename(), f.GetAdditions(), f.GetDeletions()))
+	}
+
+	sb.WriteString("Commits:\n")
+	for _, c := range pr.Commits {
+		sha := c.GetSHA()
+		if len(sha) > 7 {
+			sha = sha[:7]
 		}
-		systemPrompt = cfg.Ai.Commands[command].SystemPrompt + intent + "\n"
-	} else {
-		systemPrompt = cfg.Ai.Commands[command].SystemPrompt
+		subject, _, _ := strings.Cut(c.GetCommit().GetMessage(), "\n")
+		sb.WriteString(fmt.Sprintf("- %s %s\n", sha, subject))
+	}
+
+	if pr.Diff != "" {
+		sb.WriteString("Diff:\n")
+		sb.WriteString(pr.Diff)
+		if !strings.HasSuffix(pr.Diff, "\n") {
+			sb.WriteString("\n")
+		}
+		if len(pr.Diff) < pr.DiffBytes {
+			sb.WriteString(fmt.Sprintf("[The diff was cut to %d of %d bytes]\n", len(pr.Diff), pr.DiffBytes))
+		}
+	}
+	return sb.String()
+}
+
+// Report whether a comment by login was posted by alert-menta, whose login is self, or by GitHub Actions
+func isOwnComment(login, self string) bool {
+	return login == self || login == github.ActionsLogin
+}
+
+// Get the review comments of a pull request as comments of the thread, except the ones by self, see isOwnComment
+func reviewComments(pr *github.PullRequest, self string) []threadComment {
+	var thread []threadComment
+	for _, c := range pr.ReviewComments {
+		login := c.GetUser().GetLogin()
+		if isOwnComment(login, self) {
+			continue
+		}
+		thread = append(thread, threadComment{
+			author:    login,
+			body:      c.GetBody(),
+			path:      c.GetPath(),
+			line:      fmt.Sprintf("%s (review comment on %s):%s\n", login, c.GetPath(), c.GetBody()),
+			source:    fmt.Sprintf("a review comment by @%s on %s", login, c.GetPath()),
+			createdAt: c.GetCreatedAt(),
+		})
+	}
+	return thread
+}
+
+// Construct AI prompt. The system prompt of the command is rendered as a template with data.
+// The intent and the options given to the command are appended, unless the template refers to them.
+func constructPrompt(command string, data *utils.PromptData, userPrompt string, imgs []ai.Image, cfg *utils.Config, logger *log.Logger) (*ai.Prompt, error) {
+	cmd := cfg.Ai.Commands[command]
+	if cmd.RequireIntent && data.Intent == "" {
+		return nil, fmt.Errorf("intent is required for '%s' command", command)
+	}
+	tmpl, err := utils.ParsePromptTemplate("system_prompt", cmd.SystemPrompt)
+	if err != nil {
+		return nil, err
+	}
+	var sb strings.Builder
+	if err := tmpl.Execute(&sb, data); err != nil {
+		return nil, fmt.Errorf("executing system_prompt: %w", err)
+	}
+	systemPrompt := sb.String()
+	if cmd.RequireIntent && !utils.UsesField(tmpl, "Intent") {
+		systemPrompt += data.Intent + "\n"
+	}
+	if !utils.UsesField(tmpl, "Options") {
+		systemPrompt += formatOptions(data.Options)
 	}
 	logger.Println("\x1b[34mPrompt: |\n", systemPrompt, userPrompt, "\x1b[0m")
-	return &ai.Prompt{UserPrompt: userPrompt, SystemPrompt: systemPrompt, Images: imgs}, nil
+	params := ai.Params{Temperature: cmd.Temperature, TopP: cmd.TopP, MaxTokens: cmd.MaxTokens, Seed: cmd.Seed}
+	return &ai.Prompt{UserPrompt: userPrompt, SystemPrompt: systemPrompt, Images: imgs, Params: params}, nil
+}
+
+// Apply the provider and model of the command, if it has them. The provider of the command replaces ai.provider,
+// and is left out of the fallback providers. The model replaces the model of the provider.
+func commandConfig(command string, cfg *utils.Config) *utils.Config {
+	cmd := cfg.Ai.Commands[command]
+	if cmd.Provider == "" && cmd.Model == "" {
+		return cfg
+	}
+	commandCfg := *cfg
+	if cmd.Provider != "" {
+		commandCfg.Ai.Provider = cmd.Provider
+		commandCfg.Ai.FallbackProviders = slices.DeleteFunc(slices.Clone(cfg.Ai.FallbackProviders), func(p string) bool { return p == cmd.Provider })
+	}
+	if cmd.Model != "" {
+		switch commandCfg.Ai.Provider {
+		case "openai":
+			commandCfg.Ai.OpenAI.Model = cmd.Model
+		case "vertexai":
+			commandCfg.Ai.VertexAI.Model = cmd.Model
+		case "anthropic":
+			commandCfg.Ai.Anthropic.Model = cmd.Model
+		case "azure_openai":
+			commandCfg.Ai.AzureOpenAI.Deployment = cmd.Model
+		}
+	}
+	return &commandCfg
+}
+
+// Get the response from the AI, giving up after the timeout (0 means no timeout).
+// When a fallback chain is configured, the timeout applies to each provider and the provider that answered is noted in the comment.
+func getResponse(ctx context.Context, aic ai.Ai, prompt *ai.Prompt, timeout time.Duration) (string, error) {
+	fallback, ok := aic.(*ai.Fallback)
+	if !ok {
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		return aic.GetResponse(ctx, prompt)
+	}
+	comment, provider, err := fallback.GetResponseWithProvider(ctx, prompt)
+	if err != nil {
+		return "", err
+	}
+	return comment + fmt.Sprintf("\n\n---\n<sub>Answered by `%s`</sub>", provider), nil
+}
+
+// Initialize AI client. apiKeys holds the API key for each provider name.
+// If fallback providers are configured, a client that tries each provider in turn is returned.
+func getAIClient(ctx context.Context, apiKeys map[string]string, cfg *utils.Config, logger *log.Logger) (ai.Ai, error) {
+	primary, err := newAIClient(ctx, cfg.Ai.Provider, apiKeys, cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.Ai.FallbackProviders) == 0 {
+		return primary, nil
+	}
+
+	names := []string{cfg.Ai.Provider}
+	clients := []ai.Ai{primary}
+	for _, provider := range cfg.Ai.FallbackProviders {
+		aic, err := newAIClient(ctx, provider, apiKeys, cfg, logger)
+		if err != nil {
+			return nil, fmt.Errorf("fallback provider %s: %w", provider, err)
+		}
+		names = append(names, provider)
+		clients = append(clients, aic)
+	}
+	logger.Println("Fallback providers:", strings.Join(cfg.Ai.FallbackProviders, ", "))
+	return ai.NewFallbackClient(names, clients, cfg.Ai.Timeout)
+}
+
+// Initialize the AI client for a single provider, retrying failed calls according to the provider's retry settings
+func newAIClient(ctx context.Context, provider string, apiKeys map[string]string, cfg *utils.Config, logger *log.Logger) (ai.Ai, error) {
+	aic, err := newProviderClient(ctx, provider, apiKeys, cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	retries := map[string]utils.Retry{
+		"openai":       cfg.Ai.OpenAI.Retry,
+		"vertexai":     cfg.Ai.VertexAI.Retry,
+		"anthropic":    cfg.Ai.Anthropic.Retry,
+		"azure_openai": cfg.Ai.AzureOpenAI.Retry,
+	}
+	retry, err := ai.NewRetryClient(aic, newRetryPolicy(retries[provider]))
+	if err != nil {
+		return nil, fmt.Errorf("%s retry: %w", provider, err)
+	}
+	return retry, nil
+}
+
+// Build the retry policy from the configuration. Unset fields use the defaults.
+func newRetryPolicy(cfg utils.Retry) ai.RetryPolicy {
+	policy := ai.DefaultRetryPolicy()
+	if cfg.MaxAttempts != 0 {
+		policy.MaxAttempts = cfg.MaxAttempts
+	}
+	if cfg.BaseDelay != 0 {
+		policy.BaseDelay = cfg.BaseDelay
+	}
+	if cfg.MaxDelay != 0 {
+		policy.MaxDelay = cfg.MaxDelay
+	}
+	if cfg.Jitter != 0 {
+		policy.Jitter = cfg.Jitter
+	}
+	policy.IgnoreRetryAfter = cfg.IgnoreRetryAfter
+	return policy
 }
 
-// Initialize AI client
-func getAIClient(oaiKey string, cfg *utils.Config, logger *log.Logger) (ai.Ai, error) {
-	switch cfg.Ai.Provider {
+// Initialize the AI client of the provider
+func newProviderClient(ctx context.Context, provider string, apiKeys map[string]string, cfg *utils.Config, logger *log.Logger) (ai.Ai, error) {
+	switch provider {
 	case "openai":
-		if oaiKey == "" {
+		oaiKey := apiKeys["openai"]
+		if oaiKey == "" && !cfg.Ai.OpenAI.NoAPIKey {
 			return nil, fmt.Errorf("OpenAI API key is required")
 		}
-		logger.Println("Using OpenAI API")
 		logger.Println("OpenAI model:", cfg.Ai.OpenAI.Model)
+		if cfg.Ai.OpenAI.BaseURL != "" {
+			logger.Println("Using OpenAI-compatible API:", cfg.Ai.OpenAI.BaseURL)
+			return ai.NewOpenAICompatibleClient(cfg.Ai.OpenAI.BaseURL, oaiKey, cfg.Ai.OpenAI.Model, cfg.Ai.OpenAI.Headers), nil
+		}
+		logger.Println("Using OpenAI API")
 		return ai.NewOpenAIClient(oaiKey, cfg.Ai.OpenAI.Model), nil
 	case "vertexai":
 		logger.Println("Using VertexAI API")
 		logger.Println("VertexAI model:", cfg.Ai.VertexAI.Model)
-		aic, err := ai.NewVertexAIClient(cfg.Ai.VertexAI.Project, cfg.Ai.VertexAI.Region, cfg.Ai.VertexAI.Model)
+		aic, err := ai.NewVertexAIClient(ctx, cfg.Ai.VertexAI.Project, cfg.Ai.VertexAI.Region, cfg.Ai.VertexAI.Model)
 		if err != nil {
 			return nil, fmt.Errorf("new Vertex AI client: %w", err)
 		}
 		return aic, nil
+	case "azure_openai":
+		if cfg.Ai.AzureOpenAI.Endpoint == "" || cfg.Ai.AzureOpenAI.Deployment == "" {
+			return nil, fmt.Errorf("Azure OpenAI endpoint and deployment are required")
+		}
+		logger.Println("Using Azure OpenAI API:", cfg.Ai.AzureOpenAI.Endpoint)
+		logger.Println("Azure OpenAI deployment:", cfg.Ai.AzureOpenAI.Deployment)
+		if apiKeys["azure_openai"] == "" {
+			logger.Println("Azure OpenAI API key is not set, using Microsoft Entra ID authentication")
+		}
+		aic, err := ai.NewAzureOpenAIClient(cfg.Ai.AzureOpenAI.Endpoint, cfg.Ai.AzureOpenAI.Deployment, cfg.Ai.AzureOpenAI.APIVersion, apiKeys["azure_openai"])
+		if err != nil {
+			return nil, fmt.Errorf("new Azure OpenAI client: %w", err)
+		}
+		return aic, nil
+	case "anthropic":
+		anthropicKey := apiKeys["anthropic"]
+		if anthropicKey == "" {
+			return nil, fmt.Errorf("Anthropic API key is required")
+		}
+		logger.Println("Using Anthropic API")
+		logger.Println("Anthropic model:", cfg.Ai.Anthropic.Model)
+		return ai.NewAnthropicClient(anthropicKey, cfg.Ai.Anthropic.Model, cfg.Ai.Anthropic.MaxTokens), nil
 	default:
-		return nil, fmt.Errorf("invalid provider: %s", cfg.Ai.Provider)
+		return nil, fmt.Errorf("invalid provider: %s", provider)
 	}
 }
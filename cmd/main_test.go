@@ -1,13 +1,32 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"image"
+	"image/png"
 	"log"
+	"maps"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+	"unicode/utf8"
 
 	"github.com/3-shake/alert-menta/internal/ai"
+	"github.com/3-shake/alert-menta/internal/github"
 	"github.com/3-shake/alert-menta/internal/utils"
+	gogithub "github.com/google/go-github/github"
+	"golang.org/x/oauth2"
 )
 
 // Test for validateCommand
@@ -41,8 +60,10 @@ func TestConstructPrompt(t *testing.T) {
 	mockCfg := &utils.Config{
 		Ai: utils.Ai{
 			Commands: map[string]utils.Command{
-				"ask":   {SystemPrompt: "Ask system prompt: ", RequireIntent: true},
-				"other": {SystemPrompt: "Other system prompt: ", RequireIntent: false},
+				"ask":      {SystemPrompt: "Ask system prompt: ", RequireIntent: true},
+				"other":    {SystemPrompt: "Other system prompt: ", RequireIntent: false},
+				"template": {SystemPrompt: `Answer "{{ .Intent }}" about {{ .Issue.Title }}`, RequireIntent: true},
+				"options":  {SystemPrompt: `Answer in {{ index .Options "lang" }}`},
 			},
 		},
 	}
@@ -54,19 +75,24 @@ func TestConstructPrompt(t *testing.T) {
 		name                 string
 		command              string
 		intent               string
+		options              map[string]string
 		userPrompt           string
 		imgs                 []ai.Image
 		expectErr            bool
 		expectedSystemPrompt string
 	}{
-		{"Valid Ask Command with Intent", "ask", "What is the first thing to work on in suggestions?", "userPrompt", []ai.Image{}, false, "Ask system prompt: What is the first thing to work on in suggestions?\n"},
-		{"Ask Command without Intent", "ask", "", "userPrompt", []ai.Image{}, true, ""},
-		{"Valid Other Command", "other", "", "userPrompt", []ai.Image{}, false, "Other system prompt: "},
+		{"Valid Ask Command with Intent", "ask", "What is the first thing to work on in suggestions?", nil, "userPrompt", []ai.Image{}, false, "Ask system prompt: What is the first thing to work on in suggestions?\n"},
+		{"Ask Command without Intent", "ask", "", nil, "userPrompt", []ai.Image{}, true, ""},
+		{"Valid Other Command", "other", "", nil, "userPrompt", []ai.Image{}, false, "Other system prompt: "},
+		{"Command with Options", "other", "", map[string]string{"lang": "ja", "format": "table"}, "userPrompt", []ai.Image{}, false, "Other system prompt: Options:\n- format: table\n- lang: ja\n"},
+		{"Template with Intent", "template", "Why?", nil, "userPrompt", []ai.Image{}, false, "Answer \"Why?\" about Title"},
+		{"Template with Options", "options", "", map[string]string{"lang": "ja"}, "userPrompt", []ai.Image{}, false, "Answer in ja"},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			prompt, err := constructPrompt(tt.command, tt.intent, tt.userPrompt, tt.imgs, mockCfg, logger)
+			data := &utils.PromptData{Intent: tt.intent, Options: tt.options, Issue: utils.PromptIssue{Title: "Title"}}
+			prompt, err := constructPrompt(tt.command, data, tt.userPrompt, tt.imgs, mockCfg, logger)
 			if (err != nil) != tt.expectErr {
 				t.Errorf("expected error: %v, got error %v", tt.expectErr, err)
 			}
@@ -94,18 +120,22 @@ func TestGetAIClient(t *testing.T) {
 	}
 
 	tests := []struct {
-		oaiKey    string
+		apiKey    string
 		expectErr bool
 		provider  string
 	}{
 		{"valid-key", false, "openai"},
 		{"", true, "openai"},
+		{"valid-key", false, "anthropic"},
+		{"", true, "anthropic"},
+		{"valid-key", true, "azure_openai"},
 		{"", true, "invalid"},
 	}
 
 	for _, tt := range tests {
 		mockCfg.Ai.Provider = tt.provider
-		_, err := getAIClient(tt.oaiKey, mockCfg, log.New(os.Stdout, "", 0))
+		apiKeys := map[string]string{tt.provider: tt.apiKey}
+		_, err := getAIClient(context.Background(), apiKeys, mockCfg, log.New(os.Stdout, "", 0))
 		if (err != nil) != tt.expectErr {
 			t.Errorf("expected error: %v, got %v", tt.expectErr, err)
 		}
@@ -128,13 +158,341 @@ func TestGetAvailableCommands(t *testing.T) {
 	}
 }
 
+// Test for checkCommand
+func TestCheckCommand(t *testing.T) {
+	mockCfg := &utils.Config{
+		Ai: utils.Ai{
+			Commands: map[string]utils.Command{
+				"ask":      {Description: "Ask", RequireIntent: true, Options: map[string]string{"lang": "Language"}},
+				"describe": {Description: "Describe"},
+			},
+		},
+	}
+
+	tests := []struct {
+		name          string
+		req           commandRequest
+		expectErr     bool
+		expectedUsage string
+	}{
+		{"Valid", commandRequest{command: "ask", intent: "Why?", options: map[string]string{"lang": "ja"}}, false, ""},
+		{"Invalid command", commandRequest{command: "unknown"}, true, "**Available commands:**"},
+		{"Missing intent", commandRequest{command: "ask"}, true, "**Usage**: `/ask [your text here]`"},
+		{"Unknown option", commandRequest{command: "describe", options: map[string]string{"lang": "ja"}}, true, "has no options"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			usage, err := checkCommand(&tt.req, mockCfg)
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("expected error: %v, got %v", tt.expectErr, err)
+			}
+			if !strings.Contains(usage, tt.expectedUsage) {
+				t.Errorf("expected the usage to contain %q, got %q", tt.expectedUsage, usage)
+			}
+		})
+	}
+}
+
+// Test for handleEvent with events that are ignored without calling GitHub
+func TestHandleEventIgnored(t *testing.T) {
+	mockCfg := &utils.Config{}
+	logger := log.New(os.Stdout, "", 0)
+
+	events := []*github.Event{
+		{CommentBody: "Thanks!", AuthorAssociation: "MEMBER"},
+		{CommentBody: "/describe", AuthorAssociation: "NONE"},
+	}
+	for _, event := range events {
+		if err := handleEvent(context.Background(), event, &githubAuth{token: "token"}, mockCfg, nil, logger); err != nil {
+			t.Errorf("expected %+v to be ignored, got %v", event, err)
+		}
+	}
+}
+
+// fakeGitHub is a GitHub stand-in for Issue #1 in owner/repo that records the comments, edits, deletions and reactions it receives.
+// The authenticated user is alert-menta.
+type fakeGitHub struct {
+	t        *testing.T
+	mu       sync.Mutex
+	requests []string
+	// JSON list of the comments on the Issue, none if empty
+	comments string
+}
+
+func (f *fakeGitHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/v3")
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case r.Method == http.MethodGet && path == "/repos/owner/repo/issues/1":
+		_, _ = w.Write([]byte(`{"number":1,"title":"Title","body":"Body","user":{"login":"alice"}}`))
+	case r.Method == http.MethodGet && path == "/user":
+		_, _ = w.Write([]byte(`{"login":"alert-menta"}`))
+	case r.Method == http.MethodGet && path == "/repos/owner/repo/issues/1/comments":
+		_, _ = w.Write([]byte(cmp.Or(f.comments, `[]`)))
+	case r.Method == http.MethodDelete:
+		f.mu.Lock()
+		f.requests = append(f.requests, r.Method+" "+path)
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPost || r.Method == http.MethodPatch:
+		var payload struct {
+			Body    string `json:"body"`
+			Content string `json:"content"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			f.t.Errorf("decoding request: %v", err)
+		}
+		f.mu.Lock()
+		f.requests = append(f.requests, r.Method+" "+path+" "+payload.Body+payload.Content)
+		f.mu.Unlock()
+		_, _ = w.Write([]byte(`{"id":9}`))
+	default:
+		f.t.Errorf("unexpected request %s %s", r.Method, path)
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// newFakeGitHub returns a fakeGitHub and an Issue that sends requests to it
+func newFakeGitHub(t *testing.T) (*fakeGitHub, *github.GitHubIssue) {
+	t.Helper()
+	fake := &fakeGitHub{t: t}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	issue, err := github.NewEnterpriseIssue("owner", "repo", 1, oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "token"}), server.URL, "")
+	if err != nil {
+		t.Fatalf("NewEnterpriseIssue returned an error: %v", err)
+	}
+	return fake, issue
+}
+
+// newFakeAI returns an OpenAI-compatible stand-in that answers every request with response
+func newFakeAI(t *testing.T, response string) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reply, _ := json.Marshal(map[string]any{
+			"id": "chatcmpl-test", "object": "chat.completion", "created": 0, "model": "test-model",
+			"choices": []any{map[string]any{"index": 0, "finish_reason": "stop", "message": map[string]any{"role": "assistant", "content": response}}},
+		})
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(reply)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// Test for constructUserPrompt with a user_template
+func TestConstructUserPromptTemplate(t *testing.T) {
+	logger := log.New(os.Stdout, "", 0)
+	fake, issue := newFakeGitHub(t)
+	// The placeholder of alert-menta is not part of the thread
+	fake.comments = `[{"id":2,"body":"Working on it","user":{"login":"alert-menta"}},{"id":3,"body":"Any news?","user":{"login":"bob"}}]`
+	cfg := &utils.Config{Ai: utils.Ai{Commands: map[string]utils.Command{
+		"describe": {SystemPrompt: "Describe.", UserTemplate: "{{ .Repo }}#{{ .Issue.Number }} by {{ .Issue.Author }}: {{ .Issue.Title }}\n{{ .Issue.Body | truncate 2 }}\n{{ len .Comments }} comments"},
+	}}}
+	req := &commandRequest{command: "describe", intent: "now"}
+	userPrompt, data, _, err := constructUserPrompt(issue, req, cfg, 0, logger)
+	if err != nil {
+		t.Fatalf("constructUserPrompt returned an error: %v", err)
+	}
+	if expected := "owner/repo#1 by alice: Title\nBo…\n1 comments"; userPrompt != expected {
+		t.Errorf("expected %q, got %q", expected, userPrompt)
+	}
+	if data.Intent != "now" || data.Issue.Body != "Body" {
+		t.Errorf("unexpected template data %+v", data)
+	}
+
+	cfg.Ai.Commands["describe"] = utils.Command{SystemPrompt: "Describe.", UserTemplate: "{{ .Issue.Missing }}"}
+	if _, _, _, err := constructUserPrompt(issue, req, cfg, 0, logger); err == nil {
+		t.Error("expected an error for an unknown field")
+	}
+}
+
+// Test for runCommand with reactions and a placeholder comment
+func TestRunCommandFeedback(t *testing.T) {
+	logger := log.New(os.Stdout, "", 0)
+	aiServer := newFakeAI(t, "Description")
+	newCfg := func(provider string) *utils.Config {
+		return &utils.Config{
+			GitHub: utils.GitHub{Placeholder: true},
+			Ai: utils.Ai{
+				Provider: provider,
+				OpenAI:   utils.OpenAI{Model: "test-model", BaseURL: aiServer.URL + "/v1", NoAPIKey: true},
+				Commands: map[string]utils.Command{"describe": {SystemPrompt: "Describe."}},
+			},
+		}
+	}
+	blankCfg := newCfg("openai")
+	blankCfg.Ai.OpenAI.BaseURL = newFakeAI(t, "\n\n").URL + "/v1"
+
+	tests := []struct {
+		name      string
+		cfg       *utils.Config
+		command   string
+		expectErr bool
+		expected  []string
+	}{
+		{"Success", newCfg("openai"), "describe", false, []string{
+			"POST /repos/owner/repo/issues/comments/5/reactions eyes",
+			"POST /repos/owner/repo/issues/1/comments Working on `/describe`…",
+			"PATCH /repos/owner/repo/issues/comments/9 Description",
+			"POST /repos/owner/repo/issues/comments/5/reactions rocket",
+		}},
+		{"AI failure", newCfg("unknown"), "describe", true, []string{
+			"POST /repos/owner/repo/issues/comments/5/reactions eyes",
+			"POST /repos/owner/repo/issues/1/comments Working on `/describe`…",
+			"PATCH /repos/owner/repo/issues/comments/9 **Error**: `/describe` failed. See the logs for details.",
+			"POST /repos/owner/repo/issues/comments/5/reactions confused",
+		}},
+		{"Blank response", blankCfg, "describe", true, []string{
+			"POST /repos/owner/repo/issues/comments/5/reactions eyes",
+			"POST /repos/owner/repo/issues/1/comments Working on `/describe`…",
+			"PATCH /repos/owner/repo/issues/comments/9 **Error**: `/describe` failed. See the logs for details.",
+			"POST /repos/owner/repo/issues/comments/5/reactions confused",
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, issue := newFakeGitHub(t)
+			err := runCommand(context.Background(), issue, &commandRequest{command: tt.command, commentID: 5}, tt.cfg, nil, logger)
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("expected error: %v, got %v", tt.expectErr, err)
+			}
+			if !slices.Equal(fake.requests, tt.expected) {
+				t.Errorf("expected requests %q, got %q", tt.expected, fake.requests)
+			}
+		})
+	}
+}
+
+// Test for githubAuth
+func TestGitHubAuth(t *testing.T) {
+	auth := &githubAuth{token: "token"}
+	if !auth.isSet() {
+		t.Error("expected a token to be accepted")
+	}
+	if err := auth.init(&utils.Config{}); err != nil {
+		t.Errorf("init returned an error: %v", err)
+	}
+	if (&githubAuth{}).isSet() {
+		t.Error("expected no credentials without a token or app")
+	}
+
+	if err := (&githubAuth{token: "token", appID: 1}).init(&utils.Config{}); err == nil {
+		t.Error("expected an error with both a token and an app")
+	}
+	t.Setenv("GITHUB_APP_PRIVATE_KEY", "")
+	if err := (&githubAuth{appID: 1}).init(&utils.Config{}); err == nil {
+		t.Error("expected an error without a private key")
+	}
+	if err := (&githubAuth{appID: 1, privateKeyFile: "missing.pem"}).init(&utils.Config{}); err == nil {
+		t.Error("expected an error with a missing private key file")
+	}
+}
+
+// Test for applyEvent
+func TestApplyEvent(t *testing.T) {
+	event := &github.Event{Owner: "owner", Repo: "repo", Number: 12, CommentBody: "/describe"}
+
+	cfg := &Config{}
+	applyEvent(cfg, event)
+	if cfg.owner != "owner" || cfg.repo != "repo" || cfg.issueNumber != 12 || cfg.commentBody != "/describe" {
+		t.Errorf("expected the arguments from the event, got %+v", cfg)
+	}
+
+	// Flags take precedence over the event
+	cfg = &Config{repo: "other", issueNumber: 1, command: "suggest"}
+	applyEvent(cfg, event)
+	if cfg.owner != "owner" || cfg.repo != "other" || cfg.issueNumber != 1 || cfg.commentBody != "" {
+		t.Errorf("expected the flags to take precedence, got %+v", cfg)
+	}
+}
+
+// Test for authorAllowed
+func TestAuthorAllowed(t *testing.T) {
+	tests := []struct {
+		name        string
+		allowed     []string
+		association string
+		expected    bool
+	}{
+		{"Default member", nil, "MEMBER", true},
+		{"Default contributor", nil, "CONTRIBUTOR", false},
+		{"Configured collaborator", []string{"collaborator"}, "COLLABORATOR", true},
+		{"Configured without owner", []string{"COLLABORATOR"}, "OWNER", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCfg := &utils.Config{GitHub: utils.GitHub{AllowedAssociations: tt.allowed}}
+			if got := authorAllowed(tt.association, mockCfg); got != tt.expected {
+				t.Errorf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+// Test for parseCommentBody
+func TestParseCommentBody(t *testing.T) {
+	cmd, err := parseCommentBody("-", strings.NewReader("/ask What happened?\nIt's \"down\""))
+	if err != nil {
+		t.Fatalf("parseCommentBody returned an error: %v", err)
+	}
+	if cmd.Name != "ask" || cmd.Intent != "What happened?\nIt's \"down\"" {
+		t.Errorf("unexpected command from stdin: %+v", cmd)
+	}
+
+	cmd, err = parseCommentBody("/describe", strings.NewReader("/ask ignored"))
+	if err != nil {
+		t.Fatalf("parseCommentBody returned an error: %v", err)
+	}
+	if cmd.Name != "describe" {
+		t.Errorf("expected command 'describe', got %q", cmd.Name)
+	}
+}
+
+// Test for validateOptions
+func TestValidateOptions(t *testing.T) {
+	mockCfg := &utils.Config{
+		Ai: utils.Ai{
+			Commands: map[string]utils.Command{
+				"ask": {Options: map[string]string{"lang": "Language of the answer"}},
+			},
+		},
+	}
+
+	tests := []struct {
+		name      string
+		options   map[string]string
+		expectErr bool
+	}{
+		{"No options", nil, false},
+		{"Known option", map[string]string{"lang": "ja"}, false},
+		{"Unknown option", map[string]string{"model": "gpt-4o"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateOptions("ask", tt.options, mockCfg); (err != nil) != tt.expectErr {
+				t.Errorf("expected error: %v, got %v", tt.expectErr, err)
+			}
+		})
+	}
+	if usage := optionsUsage("ask", mockCfg); !strings.Contains(usage, "`--lang=...`: Language of the answer") {
+		t.Errorf("expected the usage to list --lang, got %q", usage)
+	}
+}
+
 // Test for commandNeedsIntent
 func TestCommandNeedsIntent(t *testing.T) {
 	mockCfg := &utils.Config{
 		Ai: utils.Ai{
 			Commands: map[string]utils.Command{
-				"ask":   {SystemPrompt: "Ask system prompt: ", RequireIntent: true},
-				"other": {SystemPrompt: "Other system prompt: ", RequireIntent: false},
+				"ask":      {SystemPrompt: "Ask system prompt: ", RequireIntent: true},
+				"other":    {SystemPrompt: "Other system prompt: ", RequireIntent: false},
+				"template": {SystemPrompt: `Answer "{{ .Intent }}" about {{ .Issue.Title }}`, RequireIntent: true},
+				"options":  {SystemPrompt: `Answer in {{ index .Options "lang" }}`},
 			},
 		},
 	}
@@ -163,3 +521,558 @@ func TestCommandNeedsIntent(t *testing.T) {
 		}
 	}
 }
+
+// Test for getAIClient with an OpenAI-compatible endpoint
+func TestGetAIClientOpenAICompatible(t *testing.T) {
+	tests := []struct {
+		name      string
+		oaiKey    string
+		noAPIKey  bool
+		expectErr bool
+	}{
+		{"With API key", "valid-key", false, false},
+		{"No API key mode", "", true, false},
+		{"Missing API key", "", false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCfg := &utils.Config{
+				Ai: utils.Ai{
+					Provider: "openai",
+					OpenAI: utils.OpenAI{
+						Model:    "llama3",
+						BaseURL:  "http://localhost:11434/v1",
+						NoAPIKey: tt.noAPIKey,
+					},
+				},
+			}
+			_, err := getAIClient(context.Background(), map[string]string{"openai": tt.oaiKey}, mockCfg, log.New(os.Stdout, "", 0))
+			if (err != nil) != tt.expectErr {
+				t.Errorf("expected error: %v, got %v", tt.expectErr, err)
+			}
+		})
+	}
+}
+
+// Test for getAIClient with Azure OpenAI
+func TestGetAIClientAzureOpenAI(t *testing.T) {
+	tests := []struct {
+		name       string
+		endpoint   string
+		deployment string
+		expectErr  bool
+	}{
+		{"Valid", "https://example.openai.azure.com", "gpt-4o", false},
+		{"Missing endpoint", "", "gpt-4o", true},
+		{"Missing deployment", "https://example.openai.azure.com", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCfg := &utils.Config{
+				Ai: utils.Ai{
+					Provider: "azure_openai",
+					AzureOpenAI: utils.AzureOpenAI{
+						Endpoint:   tt.endpoint,
+						Deployment: tt.deployment,
+						APIVersion: "2024-06-01",
+					},
+				},
+			}
+			_, err := getAIClient(context.Background(), map[string]string{"azure_openai": "valid-key"}, mockCfg, log.New(os.Stdout, "", 0))
+			if (err != nil) != tt.expectErr {
+				t.Errorf("expected error: %v, got %v", tt.expectErr, err)
+			}
+		})
+	}
+}
+
+// Test for getAIClient with fallback providers
+func TestGetAIClientFallback(t *testing.T) {
+	tests := []struct {
+		name           string
+		fallbacks      []string
+		expectErr      bool
+		expectFallback bool
+	}{
+		{"No fallback", nil, false, false},
+		{"Valid fallback", []string{"anthropic"}, false, true},
+		{"Invalid fallback", []string{"invalid"}, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCfg := &utils.Config{
+				Ai: utils.Ai{
+					Provider:          "openai",
+					FallbackProviders: tt.fallbacks,
+				},
+			}
+			apiKeys := map[string]string{"openai": "valid-key", "anthropic": "valid-key"}
+			aic, err := getAIClient(context.Background(), apiKeys, mockCfg, log.New(os.Stdout, "", 0))
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("expected error: %v, got %v", tt.expectErr, err)
+			}
+			if _, ok := aic.(*ai.Fallback); ok != tt.expectFallback {
+				t.Errorf("expected fallback client: %v, got %T", tt.expectFallback, aic)
+			}
+		})
+	}
+}
+
+// Test for newRetryPolicy
+func TestNewRetryPolicy(t *testing.T) {
+	defaults := ai.DefaultRetryPolicy()
+
+	policy := newRetryPolicy(utils.Retry{})
+	if policy != defaults {
+		t.Errorf("expected default policy %+v, got %+v", defaults, policy)
+	}
+
+	policy = newRetryPolicy(utils.Retry{MaxAttempts: 5, BaseDelay: time.Second, IgnoreRetryAfter: true})
+	if policy.MaxAttempts != 5 || policy.BaseDelay != time.Second || !policy.IgnoreRetryAfter {
+		t.Errorf("expected configured values, got %+v", policy)
+	}
+	if policy.MaxDelay != defaults.MaxDelay || policy.Jitter != defaults.Jitter {
+		t.Errorf("expected default max delay and jitter, got %+v", policy)
+	}
+}
+
+// slowAi is an Ai that answers after a delay unless the context is done first
+type slowAi struct {
+	response string
+	delay    time.Duration
+}
+
+func (s *slowAi) GetResponse(ctx context.Context, prompt *ai.Prompt) (string, error) {
+	select {
+	case <-time.After(s.delay):
+		return s.response, nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// Test for getResponse
+func TestGetResponse(t *testing.T) {
+	prompt := &ai.Prompt{UserPrompt: "userPrompt"}
+
+	// Times out
+	_, err := getResponse(context.Background(), &slowAi{response: "late", delay: time.Second}, prompt, 50*time.Millisecond)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	// Notes the provider that answered when a fallback chain is configured
+	fallback, err := ai.NewFallbackClient(
+		[]string{"openai", "vertexai"},
+		[]ai.Ai{&slowAi{response: "late", delay: time.Second}, &slowAi{response: "answer"}},
+		50*time.Millisecond,
+	)
+	if err != nil {
+		t.Fatalf("NewFallbackClient returned an error: %v", err)
+	}
+	comment, err := getResponse(context.Background(), fallback, prompt, 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("getResponse returned an error: %v", err)
+	}
+	expected := "answer\n\n---\n<sub>Answered by `vertexai`</sub>"
+	if comment != expected {
+		t.Errorf("expected comment %q, got %q", expected, comment)
+	}
+}
+
+// Test for inputTokenBudget
+func TestInputTokenBudget(t *testing.T) {
+	mockCfg := &utils.Config{
+		Ai: utils.Ai{
+			Provider: "openai",
+			OpenAI:   utils.OpenAI{Model: "gpt-4o-mini"},
+			Commands: map[string]utils.Command{
+				"ask": {SystemPrompt: strings.Repeat("s", 400), RequireIntent: true},
+			},
+		},
+	}
+
+	tests := []struct {
+		name           string
+		maxInputTokens int
+		intent         string
+		expected       int
+	}{
+		{"No limit", 0, "", 0},
+		{"System prompt is subtracted", 1000, "", 900},
+		{"Intent is subtracted", 1000, strings.Repeat("i", 40), 890},
+		{"System prompt over the limit", 50, "", 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCfg.Ai.MaxInputTokens = tt.maxInputTokens
+			if got := inputTokenBudget("ask", tt.intent, mockCfg); got != tt.expected {
+				t.Errorf("expected budget %d, got %d", tt.expected, got)
+			}
+		})
+	}
+}
+
+// Test for inputTokenBudget with fallback providers
+func TestInputTokenBudgetFallback(t *testing.T) {
+	mockCfg := &utils.Config{
+		Ai: utils.Ai{
+			Provider:          "openai",
+			FallbackProviders: []string{"anthropic"},
+			OpenAI:            utils.OpenAI{Model: "gpt-4o-mini"},
+			Anthropic:         utils.Anthropic{Model: "claude-sonnet-4-5"},
+			MaxInputTokens:    1000,
+			Commands: map[string]utils.Command{
+				"describe": {SystemPrompt: strings.Repeat("s", 350)},
+			},
+		},
+	}
+
+	// The system prompt is counted with the Anthropic model, which has more tokens per character
+	if got := inputTokenBudget("describe", "", mockCfg); got != 900 {
+		t.Errorf("expected budget 900, got %d", got)
+	}
+}
+
+// Test for imageNotePlaceholder
+func TestImageNotePlaceholder(t *testing.T) {
+	if got := imageNotePlaceholder("no images", 10); got != "" {
+		t.Errorf("expected no placeholder, got %q", got)
+	}
+	expected := "[Attached images: Image 10, Image 10]\n"
+	if got := imageNotePlaceholder("![a](https://github.com/a.png) ![b](https://github.com/b.png)", 10); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+	expected = "[Attached images: Image 1]\n"
+	if got := imageNotePlaceholder("![a](https://github.com/a.png) ![b](https://github.com/b.png)", 1); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+// Test for postStickyComment with a response in several parts
+func TestPostStickyComment(t *testing.T) {
+	logger := log.New(os.Stdout, "", 0)
+	fake, issue := newFakeGitHub(t)
+	// The previous response had 3 parts, and mallory copied the marker of part 2
+	fake.comments = `[{"id":1,"body":"<!-- alert-menta:describe -->\nold 1","user":{"login":"alert-menta"}},` +
+		`{"id":2,"body":"<!-- alert-menta:describe:part-2 -->\nold 2","user":{"login":"alert-menta"}},` +
+		`{"id":3,"body":"<!-- alert-menta:describe:part-3 -->\nold 3","user":{"login":"alert-menta"}},` +
+		`{"id":4,"body":"<!-- alert-menta:describe:part-2 -->\nfake","user":{"login":"mallory"}}]`
+	if err := postStickyComment(issue, "describe", []string{"new 1", "new 2"}, logger); err != nil {
+		t.Fatalf("postStickyComment returned an error: %v", err)
+	}
+	if len(fake.requests) != 3 {
+		t.Fatalf("expected 3 requests, got %q", fake.requests)
+	}
+	if !strings.HasPrefix(fake.requests[0], "PATCH /repos/owner/repo/issues/comments/1 <!-- alert-menta:describe -->\nnew 1") ||
+		!strings.Contains(fake.requests[0], "old 1") {
+		t.Errorf("expected the first comment to be updated with the history, got %q", fake.requests[0])
+	}
+	if expected := "PATCH /repos/owner/repo/issues/comments/2 <!-- alert-menta:describe:part-2 -->\nnew 2"; fake.requests[1] != expected {
+		t.Errorf("expected %q, got %q", expected, fake.requests[1])
+	}
+	if expected := "DELETE /repos/owner/repo/issues/comments/3"; fake.requests[2] != expected {
+		t.Errorf("expected %q, got %q", expected, fake.requests[2])
+	}
+
+	// Without previous comments, every part is posted
+	fake.comments, fake.requests = "", nil
+	if err := postStickyComment(issue, "describe", []string{"new 1", "new 2"}, logger); err != nil {
+		t.Fatalf("postStickyComment returned an error: %v", err)
+	}
+	expected := []string{
+		"POST /repos/owner/repo/issues/1/comments <!-- alert-menta:describe -->\nnew 1",
+		"POST /repos/owner/repo/issues/1/comments <!-- alert-menta:describe:part-2 -->\nnew 2",
+	}
+	if !slices.Equal(fake.requests, expected) {
+		t.Errorf("expected %q, got %q", expected, fake.requests)
+	}
+}
+
+// Test for updateStickyBody
+func TestUpdateStickyBody(t *testing.T) {
+	marker := stickyMarker("describe")
+	at := time.Date(2026, 1, 2, 3, 4, 0, 0, time.UTC)
+
+	body := updateStickyBody(marker, marker+"first", at, "second")
+	expected := marker + "second" + stickyHistoryStart + "**2026-01-02 03:04 UTC**\n\nfirst" + stickyHistoryEnd
+	if body != expected {
+		t.Fatalf("expected %q, got %q", expected, body)
+	}
+	if got := withoutStickyHistory(body); got != marker+"second" {
+		t.Errorf("expected the history to be removed, got %q", got)
+	}
+
+	// The newest versions come first, and the oldest ones are dropped over the limit
+	for i := 3; i <= maxStickyVersions+3; i++ {
+		body = updateStickyBody(marker, body, at.Add(time.Duration(i)*time.Hour), fmt.Sprintf("response %d", i))
+	}
+	_, history, _ := strings.Cut(body, stickyHistoryStart)
+	versions := strings.Split(strings.TrimSuffix(history, stickyHistoryEnd), stickyVersionSep)
+	if len(versions) != maxStickyVersions {
+		t.Fatalf("expected %d versions, got %d", maxStickyVersions, len(versions))
+	}
+	if !strings.HasSuffix(versions[0], fmt.Sprintf("response %d", maxStickyVersions+2)) {
+		t.Errorf("expected the newest version first, got %q", versions[0])
+	}
+}
+
+// Test for updateStickyBody with versions over the size limit of comments
+func TestUpdateStickyBodyLimit(t *testing.T) {
+	marker := stickyMarker("describe")
+	long := strings.Repeat("a", github.MaxCommentLength/2)
+	body := updateStickyBody(marker, marker+"first", time.Now(), long)
+	if !strings.Contains(body, "first") || utf8.RuneCountInString(body) > github.MaxCommentLength {
+		t.Errorf("expected the history to be kept within the limit, got %d characters", utf8.RuneCountInString(body))
+	}
+	body = updateStickyBody(marker, marker+long, time.Now(), long)
+	if body != marker+long {
+		t.Errorf("expected the history to be dropped, got %d characters", utf8.RuneCountInString(body))
+	}
+}
+
+// Test for splitResponse
+func TestSplitResponse(t *testing.T) {
+	logger := log.New(os.Stdout, "", 0)
+	if chunks := splitResponse("short", logger); !slices.Equal(chunks, []string{"short"}) {
+		t.Errorf("expected the response as is, got %q", chunks)
+	}
+
+	paragraph := strings.Repeat("a", 40000)
+	chunks := splitResponse(paragraph+"\n\n"+paragraph, logger)
+	expected := []string{paragraph + "\n\n_(1/2)_", paragraph + "\n\n_(2/2)_"}
+	if !slices.Equal(chunks, expected) {
+		t.Fatalf("expected 2 numbered parts, got %d parts", len(chunks))
+	}
+	for _, chunk := range chunks {
+		if n := utf8.RuneCountInString(chunk); n > github.MaxCommentLength {
+			t.Errorf("part of %d characters is over the limit", n)
+		}
+	}
+}
+
+// Test for formatPullRequest
+func TestFormatPullRequest(t *testing.T) {
+	pr := &github.PullRequest{
+		Files: []*gogithub.CommitFile{
+			{Filename: gogithub.String("a.go"), Status: gogithub.String("modified"), Additions: gogithub.Int(3), Deletions: gogithub.Int(1)},
+			{Filename: gogithub.String("b.go"), Status: gogithub.String("added"), Additions: gogithub.Int(2)},
+		},
+		Commits: []*gogithub.RepositoryCommit{
+			{SHA: gogithub.String("0123456789abcdef"), Commit: &gogithub.Commit{Message: gogithub.String("Fix a\n\nDetails")}},
+		},
+		Diff:      "diff --git a/a.go b/a.go\n",
+		DiffBytes: 100,
+	}
+	expected := "Changed files (2, +5 -1):\n- modified a.go (+3 -1)\n- added b.go (+2 -0)\n" +
+		"Commits:\n- 0123456 Fix a\n" +
+		"Diff:\ndiff --git a/a.go b/a.go\n[The diff was cut to 25 of 100 bytes]\n"
+	if got := formatPullRequest(pr); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+// Test for reviewComments
+func TestReviewComments(t *testing.T) {
+	pr := &github.PullRequest{
+		ReviewComments: []*gogithub.PullRequestComment{
+			{Body: gogithub.String("Why?"), Path: gogithub.String("a.go"), User: &gogithub.User{Login: gogithub.String("bob")}},
+			{Body: gogithub.String("Answer"), Path: gogithub.String("a.go"), User: &gogithub.User{Login: gogithub.String("github-actions[bot]")}},
+			{Body: gogithub.String("Answer"), Path: gogithub.String("a.go"), User: &gogithub.User{Login: gogithub.String("alert-menta")}},
+		},
+	}
+	thread := reviewComments(pr, "alert-menta")
+	if len(thread) != 1 {
+		t.Fatalf("expected 1 review comment, got %d", len(thread))
+	}
+	if expected := "bob (review comment on a.go):Why?\n"; thread[0].line != expected {
+		t.Errorf("expected %q, got %q", expected, thread[0].line)
+	}
+}
+
+// Test for maxDiffBytes
+func TestMaxDiffBytes(t *testing.T) {
+	tests := []struct {
+		configured int
+		expected   int
+	}{
+		{0, utils.DefaultMaxDiffBytes},
+		{-1, 0},
+		{1000, 1000},
+	}
+	for _, tt := range tests {
+		if got := maxDiffBytes(utils.PullRequests{MaxDiffBytes: tt.configured}); got != tt.expected {
+			t.Errorf("max_diff_bytes %d: expected %d, got %d", tt.configured, tt.expected, got)
+		}
+	}
+}
+
+// Test for commandConfig: the provider and model of a command replace the configured ones
+func TestCommandConfig(t *testing.T) {
+	cfg := &utils.Config{Ai: utils.Ai{
+		Provider:          "openai",
+		FallbackProviders: []string{"anthropic", "vertexai"},
+		OpenAI:            utils.OpenAI{Model: "gpt-4o-mini"},
+		Anthropic:         utils.Anthropic{Model: "claude-sonnet-4-5"},
+		Commands: map[string]utils.Command{
+			"describe": {SystemPrompt: "Describe."},
+			"cheap":    {SystemPrompt: "Describe.", Model: "gpt-4.1-nano"},
+			"analysis": {SystemPrompt: "Analyze.", Provider: "anthropic", Model: "claude-opus-4-1"},
+		},
+	}}
+
+	if got := commandConfig("describe", cfg); got != cfg {
+		t.Error("expected the configuration as is for a command without provider and model")
+	}
+	if got := commandConfig("cheap", cfg); got.Ai.Provider != "openai" || got.Ai.OpenAI.Model != "gpt-4.1-nano" {
+		t.Errorf("expected the OpenAI model to be replaced, got %s %s", got.Ai.Provider, got.Ai.OpenAI.Model)
+	}
+	got := commandConfig("analysis", cfg)
+	if got.Ai.Provider != "anthropic" || got.Ai.Anthropic.Model != "claude-opus-4-1" {
+		t.Errorf("expected the Anthropic provider and model, got %s %s", got.Ai.Provider, got.Ai.Anthropic.Model)
+	}
+	if !slices.Equal(got.Ai.FallbackProviders, []string{"vertexai"}) {
+		t.Errorf("expected the command provider to be left out of the fallback providers, got %v", got.Ai.FallbackProviders)
+	}
+	if cfg.Ai.Provider != "openai" || cfg.Ai.Anthropic.Model != "claude-sonnet-4-5" || len(cfg.Ai.FallbackProviders) != 2 {
+		t.Errorf("expected the configuration to be unchanged, got %+v", cfg.Ai)
+	}
+}
+
+// Test for providerAPIKeys: flags take precedence over the keys of the configuration file
+func TestProviderAPIKeys(t *testing.T) {
+	t.Setenv("OPENAI_API_KEY", "env-openai")
+	t.Setenv("ANTHROPIC_API_KEY", "env-anthropic")
+	t.Setenv("AZURE_OPENAI_API_KEY", "env-azure")
+	cfg := &utils.Config{}
+	cfg.Ai.OpenAI.APIKey = "config-openai"
+	cfg.Ai.Anthropic.APIKey = "config-anthropic"
+	got := providerAPIKeys(map[string]string{"openai": "flag-openai", "anthropic": "", "azure_openai": ""}, cfg)
+	expected := map[string]string{"openai": "flag-openai", "anthropic": "config-anthropic", "azure_openai": "env-azure"}
+	if !maps.Equal(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+// Test for imageCollector
+func TestImageCollector(t *testing.T) {
+	imageA, imageB := testPNG(t, 4, 4, 0), testPNG(t, 4, 4, 255)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// /a.png and /copy-of-a.png have the same content
+		switch r.URL.Path {
+		case "/a.png", "/copy-of-a.png":
+			_, _ = w.Write(imageA)
+		case "/script.png":
+			_, _ = w.Write([]byte("<html><script>alert(1)</script></html>"))
+		default:
+			_, _ = w.Write(imageB)
+		}
+	}))
+	defer server.Close()
+
+	images := newImageCollector("token", utils.Images{MaxCount: 2, AllowedHosts: []string{"127.0.0.1"}, AllowPrivateNetworks: true}, "", log.New(os.Stdout, "", 0))
+
+	// Images with the same content are attached once, and non-images are skipped
+	note, err := images.collect("![a]("+server.URL+"/a.png) ![s]("+server.URL+"/script.png) ![copy]("+server.URL+"/copy-of-a.png) ![b]("+server.URL+"/b.png)", "the issue body by @alice")
+	if err != nil {
+		t.Fatalf("collect returned an error: %v", err)
+	}
+	if note != "[Attached images: Image 1, Image 2]\n" {
+		t.Errorf("unexpected note %q", note)
+	}
+
+	// The same URL is not attached again, and new images are skipped over the limit
+	note, err = images.collect("![a]("+server.URL+"/a.png) ![c]("+server.URL+"/c.png) ![again]("+server.URL+"/a.png)", "a comment by @bob")
+	if err != nil {
+		t.Fatalf("collect returned an error: %v", err)
+	}
+	if note != "[Attached images: Image 1]\n" {
+		t.Errorf("unexpected note %q", note)
+	}
+
+	note, err = images.collect("no images", "a comment by @bob")
+	if err != nil {
+		t.Fatalf("collect returned an error: %v", err)
+	}
+	if note != "" {
+		t.Errorf("expected no note, got %q", note)
+	}
+
+	if len(images.images) != 2 {
+		t.Fatalf("expected 2 images, got %d", len(images.images))
+	}
+	expectedLabel := "Image 2: from the issue body by @alice (image 4 of 4)"
+	if images.images[1].Label != expectedLabel {
+		t.Errorf("expected label %q, got %q", expectedLabel, images.images[1].Label)
+	}
+}
+
+// TestImageCollectorEnterpriseHost tests that images on a GitHub Enterprise Server are allowed unless hosts are configured
+func TestImageCollectorEnterpriseHost(t *testing.T) {
+	logger := log.New(os.Stdout, "", 0)
+	images := newImageCollector("token", utils.Images{}, "ghes.example.com", logger)
+	for _, host := range []string{"github.com", "ghes.example.com", "*.ghes.example.com"} {
+		if !slices.Contains(images.opts.AllowedHosts, host) || !slices.Contains(images.opts.TokenHosts, host) {
+			t.Errorf("expected %s in the allowed and token hosts, got %v and %v", host, images.opts.AllowedHosts, images.opts.TokenHosts)
+		}
+	}
+	if slices.Contains(utils.DefaultAllowedImageHosts, "ghes.example.com") {
+		t.Error("expected the default hosts to be unchanged")
+	}
+
+	images = newImageCollector("token", utils.Images{AllowedHosts: []string{"images.example.com"}}, "ghes.example.com", logger)
+	if !slices.Equal(images.opts.AllowedHosts, []string{"images.example.com"}) {
+		t.Errorf("expected the configured hosts, got %v", images.opts.AllowedHosts)
+	}
+}
+
+// testPNG returns a width x height PNG filled with the given gray level
+func testPNG(t *testing.T, width, height int, gray uint8) []byte {
+	t.Helper()
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	for i := range img.Pix {
+		img.Pix[i] = gray
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("Error encoding PNG: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// Test for configSources: the layers are in order, and references to other repositories are checked
+func TestConfigSources(t *testing.T) {
+	dir := t.TempDir()
+	orgFile := filepath.Join(dir, "org.yaml")
+	repoFile := filepath.Join(dir, "repo.yaml")
+	for _, file := range []string{orgFile, repoFile} {
+		if err := os.WriteFile(file, []byte("ai:\n  provider: anthropic\n"), 0o600); err != nil {
+			t.Fatalf("Error writing config file: %v", err)
+		}
+	}
+
+	sources, err := configSources(repoFile, orgFile, &githubAuth{})
+	if err != nil {
+		t.Fatalf("configSources returned an error: %v", err)
+	}
+	var names []string
+	for _, source := range sources {
+		names = append(names, source.Name)
+	}
+	if expected := []string{utils.DefaultConfigName, orgFile, repoFile}; !slices.Equal(names, expected) {
+		t.Errorf("expected sources %v, got %v", expected, names)
+	}
+
+	for _, orgConfig := range []string{"github:owner/repo", "github:owner//path.yaml"} {
+		if _, err := configSources("", orgConfig, &githubAuth{token: "token"}); err == nil || !strings.Contains(err.Error(), "invalid reference") {
+			t.Errorf("%s: expected an invalid reference error, got %v", orgConfig, err)
+		}
+	}
+	if _, err := configSources("", "github:owner/repo/path.yaml", &githubAuth{}); err == nil || !strings.Contains(err.Error(), "-github-token") {
+		t.Errorf("expected an error asking for credentials, got %v", err)
+	}
+}
@@ -1,16 +1,33 @@
 package ai
 
+import "context"
+
+// Ai is implemented by each LLM provider. Implementations must stop waiting for the model when ctx is done.
 type Ai interface {
-	GetResponse(prompt *Prompt) (string, error)
+	GetResponse(ctx context.Context, prompt *Prompt) (string, error)
 }
 
 type Image struct {
 	Data      []byte
 	Extension string
+	// Tells the model where the image came from, e.g. "Image 2: from a comment by @user (image 1 of 1)"
+	Label string
 }
 
 type Prompt struct {
 	UserPrompt   string
 	SystemPrompt string
 	Images       []Image
+	// Generation parameters of the command
+	Params Params
+}
+
+// Params are generation parameters. Unset parameters (nil or 0) use the defaults of the provider.
+type Params struct {
+	Temperature *float64
+	TopP        *float64
+	// Maximum number of tokens in the response
+	MaxTokens int
+	// Seed for deterministic sampling. Only OpenAI and Azure OpenAI support it.
+	Seed *int64
 }
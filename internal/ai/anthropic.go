@@ -0,0 +1,156 @@
+package ai
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	anthropicBaseURL          = "https://api.anthropic.com"
+	anthropicVersion          = "2023-06-01"
+	defaultAnthropicMaxTokens = 4096
+)
+
+type Anthropic struct {
+	apiKey    string
+	model     string
+	maxTokens int
+	baseURL   string
+	client    *http.Client
+}
+
+// Request and response bodies of the Messages API (https://docs.anthropic.com/en/api/messages)
+type anthropicRequest struct {
+	Model       string             `json:"model"`
+	MaxTokens   int                `json:"max_tokens"`
+	System      string             `json:"system,omitempty"`
+	Messages    []anthropicMessage `json:"messages"`
+	Temperature *float64           `json:"temperature,omitempty"`
+	TopP        *float64           `json:"top_p,omitempty"`
+}
+
+type anthropicMessage struct {
+	Role    string                  `json:"role"`
+	Content []anthropicContentBlock `json:"content"`
+}
+
+type anthropicContentBlock struct {
+	Type   string                `json:"type"`
+	Text   string                `json:"text,omitempty"`
+	Source *anthropicImageSource `json:"source,omitempty"`
+}
+
+type anthropicImageSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type"`
+	Data      string `json:"data"`
+}
+
+type anthropicResponse struct {
+	Content []anthropicContentBlock `json:"content"`
+}
+
+type anthropicErrorResponse struct {
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (ai *Anthropic) GetResponse(ctx context.Context, prompt *Prompt) (string, error) {
+	// Images are placed before the text, as recommended by the Messages API documentation
+	content := []anthropicContentBlock{}
+	for _, image := range prompt.Images {
+		// The label tells the model where the image came from
+		if image.Label != "" {
+			content = append(content, anthropicContentBlock{Type: "text", Text: image.Label})
+		}
+		content = append(content, anthropicContentBlock{
+			Type: "image",
+			Source: &anthropicImageSource{
+				Type:      "base64",
+				MediaType: "image/" + image.Extension,
+				Data:      base64.StdEncoding.EncodeToString(image.Data),
+			},
+		})
+	}
+	content = append(content, anthropicContentBlock{Type: "text", Text: prompt.UserPrompt})
+
+	maxTokens := ai.maxTokens
+	if prompt.Params.MaxTokens > 0 {
+		maxTokens = prompt.Params.MaxTokens
+	}
+	// The Messages API has no seed
+	reqBody, err := json.Marshal(anthropicRequest{
+		Model:       ai.model,
+		MaxTokens:   maxTokens,
+		System:      prompt.SystemPrompt,
+		Messages:    []anthropicMessage{{Role: "user", Content: content}},
+		Temperature: prompt.Params.Temperature,
+		TopP:        prompt.Params.TopP,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ai.baseURL+"/v1/messages", bytes.NewReader(reqBody))
+	if err != nil {
+		return "", fmt.Errorf("failed to create a new request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Api-Key", ai.apiKey)
+	req.Header.Set("Anthropic-Version", anthropicVersion)
+
+	resp, err := ai.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("Messages error: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the response body: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		message := fmt.Sprintf("unexpected status %d", resp.StatusCode)
+		var errResp anthropicErrorResponse
+		if err := json.Unmarshal(respBody, &errResp); err == nil && errResp.Error.Message != "" {
+			message = fmt.Sprintf("%s (%d %s)", errResp.Error.Message, resp.StatusCode, errResp.Error.Type)
+		}
+		return "", fmt.Errorf("Messages error: %w", &APIError{StatusCode: resp.StatusCode, Header: resp.Header, Message: message})
+	}
+
+	var msg anthropicResponse
+	if err := json.Unmarshal(respBody, &msg); err != nil {
+		return "", fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+
+	var result strings.Builder
+	for _, block := range msg.Content {
+		if block.Type == "text" {
+			result.WriteString(block.Text)
+		}
+	}
+	return result.String(), nil
+}
+
+func NewAnthropicClient(apiKey string, model string, maxTokens int) *Anthropic {
+	// max_tokens is a required parameter of the Messages API
+	if maxTokens <= 0 {
+		maxTokens = defaultAnthropicMaxTokens
+	}
+	return &Anthropic{
+		apiKey:    apiKey,
+		model:     model,
+		maxTokens: maxTokens,
+		baseURL:   anthropicBaseURL,
+		client:    &http.Client{},
+	}
+}
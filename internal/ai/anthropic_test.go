@@ -0,0 +1,153 @@
+package ai
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newTestAnthropicClient returns a client that sends requests to the given local server
+func newTestAnthropicClient(serverURL string) *Anthropic {
+	aic := NewAnthropicClient("test-key", "claude-test", 0)
+	aic.baseURL = serverURL
+	return aic
+}
+
+// TestAnthropicGetResponse tests that the request follows the Messages API and the text blocks are returned
+func TestAnthropicGetResponse(t *testing.T) {
+	var got anthropicRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/messages" {
+			t.Errorf("expected path /v1/messages, got %s", r.URL.Path)
+		}
+		if r.Header.Get("X-Api-Key") != "test-key" {
+			t.Errorf("expected api key header 'test-key', got '%s'", r.Header.Get("X-Api-Key"))
+		}
+		if r.Header.Get("Anthropic-Version") != anthropicVersion {
+			t.Errorf("expected anthropic-version %s, got %s", anthropicVersion, r.Header.Get("Anthropic-Version"))
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Fatalf("Error decoding request: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"content":[{"type":"text","text":"Hello, "},{"type":"text","text":"world"}]}`))
+	}))
+	defer server.Close()
+
+	prompt := &Prompt{
+		SystemPrompt: "system",
+		UserPrompt:   "user",
+		Images:       []Image{{Data: []byte("png-data"), Extension: "png", Label: "Image 1: from the issue body by @alice (image 1 of 1)"}},
+	}
+	resp, err := newTestAnthropicClient(server.URL).GetResponse(context.Background(), prompt)
+	if err != nil {
+		t.Fatalf("GetResponse returned an error: %v", err)
+	}
+	if resp != "Hello, world" {
+		t.Errorf("expected response 'Hello, world', got '%s'", resp)
+	}
+
+	// Validate: the system prompt is sent separately from the user content
+	if got.Model != "claude-test" {
+		t.Errorf("expected model 'claude-test', got '%s'", got.Model)
+	}
+	if got.MaxTokens != defaultAnthropicMaxTokens {
+		t.Errorf("expected max_tokens %d, got %d", defaultAnthropicMaxTokens, got.MaxTokens)
+	}
+	if got.System != "system" {
+		t.Errorf("expected system 'system', got '%s'", got.System)
+	}
+	if len(got.Messages) != 1 || got.Messages[0].Role != "user" {
+		t.Fatalf("expected a single user message, got %+v", got.Messages)
+	}
+	content := got.Messages[0].Content
+	if len(content) != 3 {
+		t.Fatalf("expected 3 content blocks, got %d", len(content))
+	}
+	if content[0].Type != "text" || content[0].Text != "Image 1: from the issue body by @alice (image 1 of 1)" {
+		t.Errorf("expected the image label first, got %+v", content[0])
+	}
+	if content[1].Type != "image" || content[1].Source == nil {
+		t.Fatalf("expected an image block after the label, got %+v", content[1])
+	}
+	if content[1].Source.MediaType != "image/png" {
+		t.Errorf("expected media_type 'image/png', got '%s'", content[1].Source.MediaType)
+	}
+	if content[1].Source.Data != base64.StdEncoding.EncodeToString([]byte("png-data")) {
+		t.Errorf("unexpected image data '%s'", content[1].Source.Data)
+	}
+	if content[2].Type != "text" || content[2].Text != "user" {
+		t.Errorf("expected text block 'user', got %+v", content[2])
+	}
+}
+
+// TestAnthropicParams tests that the generation parameters of the prompt are sent, and max_tokens overrides the client setting
+func TestAnthropicParams(t *testing.T) {
+	var got map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Fatalf("Error decoding request: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"content":[{"type":"text","text":"ok"}]}`))
+	}))
+	defer server.Close()
+
+	aic := newTestAnthropicClient(server.URL)
+	if _, err := aic.GetResponse(context.Background(), &Prompt{UserPrompt: "user"}); err != nil {
+		t.Fatalf("GetResponse returned an error: %v", err)
+	}
+	if _, ok := got["temperature"]; ok {
+		t.Errorf("expected no temperature when it is not set, got %v", got["temperature"])
+	}
+
+	temperature := 0.3
+	if _, err := aic.GetResponse(context.Background(), &Prompt{UserPrompt: "user", Params: Params{Temperature: &temperature, MaxTokens: 1000}}); err != nil {
+		t.Fatalf("GetResponse returned an error: %v", err)
+	}
+	if got["temperature"] != 0.3 || got["max_tokens"] != 1000.0 {
+		t.Errorf("expected temperature 0.3 and max_tokens 1000, got %v and %v", got["temperature"], got["max_tokens"])
+	}
+}
+
+// TestAnthropicGetResponseError tests that API errors are returned with their message
+func TestAnthropicGetResponseError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"type":"error","error":{"type":"invalid_request_error","message":"model not found"}}`))
+	}))
+	defer server.Close()
+
+	_, err := newTestAnthropicClient(server.URL).GetResponse(context.Background(), &Prompt{UserPrompt: "user"})
+	if err == nil {
+		t.Fatal("expected an error, got nil")
+	}
+	expected := "Messages error: model not found (400 invalid_request_error)"
+	if err.Error() != expected {
+		t.Errorf("expected error '%s', got '%s'", expected, err.Error())
+	}
+}
+
+// TestAnthropicGetResponseCanceled tests that a hung call returns when the context is done
+func TestAnthropicGetResponseCanceled(t *testing.T) {
+	// The handler hangs until the test finishes
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer server.Close()
+	defer close(done)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := newTestAnthropicClient(server.URL).GetResponse(ctx, &Prompt{UserPrompt: "user"})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+package ai
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/ai/azopenai"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+)
+
+type AzureOpenAI struct {
+	client     *azopenai.Client
+	deployment string
+	// API versions before maxCompletionTokensVersion only accept max_tokens
+	legacyMaxTokens bool
+}
+
+// First API version that accepts max_completion_tokens
+const maxCompletionTokensVersion = "2024-09-01"
+
+// azureAPIVersionPolicy overrides the api-version query parameter set by the azopenai client
+type azureAPIVersionPolicy struct {
+	apiVersion string
+}
+
+func (p *azureAPIVersionPolicy) Do(req *policy.Request) (*http.Response, error) {
+	q := req.Raw().URL.Query()
+	q.Set("api-version", p.apiVersion)
+	req.Raw().URL.RawQuery = q.Encode()
+	return req.Next()
+}
+
+func (ai *AzureOpenAI) GetResponse(ctx context.Context, prompt *Prompt) (string, error) {
+	return getChatCompletion(ctx, ai.client, ai.deployment, prompt, ai.legacyMaxTokens)
+}
+
+// NewAzureOpenAIClient creates a client for an Azure OpenAI deployment.
+// If apiKey is empty, Microsoft Entra ID is used through DefaultAzureCredential,
+// which supports environment credentials, workload identity federation, managed identity and the Azure CLI.
+func NewAzureOpenAIClient(endpoint, deployment, apiVersion, apiKey string) (*AzureOpenAI, error) {
+	options := &azopenai.ClientOptions{
+		ClientOptions: azcore.ClientOptions{
+			InsecureAllowCredentialWithHTTP: strings.HasPrefix(endpoint, "http://"),
+			// Retries are handled by Retry, so that all providers share the same policy
+			Retry: policy.RetryOptions{MaxRetries: -1},
+		},
+	}
+	// Runs after the azopenai client policies, so the configured version takes precedence
+	if apiVersion != "" {
+		options.PerRetryPolicies = []policy.Policy{&azureAPIVersionPolicy{apiVersion: apiVersion}}
+	}
+
+	var client *azopenai.Client
+	var err error
+	if apiKey != "" {
+		client, err = azopenai.NewClientWithKeyCredential(endpoint, azcore.NewKeyCredential(apiKey), options)
+	} else {
+		cred, credErr := azidentity.NewDefaultAzureCredential(nil)
+		if credErr != nil {
+			return nil, fmt.Errorf("new Entra ID credential: %w", credErr)
+		}
+		client, err = azopenai.NewClient(endpoint, cred, options)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Azure OpenAI client: %w", err)
+	}
+
+	// Versions are dates, optionally followed by "-preview", e.g. "2024-06-01" or "2024-09-01-preview"
+	return &AzureOpenAI{
+		client:          client,
+		deployment:      deployment,
+		legacyMaxTokens: apiVersion != "" && apiVersion < maxCompletionTokensVersion,
+	}, nil
+}
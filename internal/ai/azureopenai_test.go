@@ -0,0 +1,38 @@
+package ai
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestAzureOpenAIGetResponse tests that requests go to the deployment with the configured api-version and key
+func TestAzureOpenAIGetResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/openai/deployments/my-deployment/chat/completions" {
+			t.Errorf("expected deployment path, got %s", r.URL.Path)
+		}
+		if r.URL.Query().Get("api-version") != "2024-06-01" {
+			t.Errorf("expected api-version '2024-06-01', got '%s'", r.URL.Query().Get("api-version"))
+		}
+		if r.Header.Get("Api-Key") != "test-key" {
+			t.Errorf("expected api-key 'test-key', got '%s'", r.Header.Get("Api-Key"))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(openAITestResponse))
+	}))
+	defer server.Close()
+
+	aic, err := NewAzureOpenAIClient(server.URL, "my-deployment", "2024-06-01", "test-key")
+	if err != nil {
+		t.Fatalf("NewAzureOpenAIClient returned an error: %v", err)
+	}
+	resp, err := aic.GetResponse(context.Background(), &Prompt{SystemPrompt: "system", UserPrompt: "user"})
+	if err != nil {
+		t.Fatalf("GetResponse returned an error: %v", err)
+	}
+	if resp != "Hello from a local model" {
+		t.Errorf("expected response 'Hello from a local model', got '%s'", resp)
+	}
+}
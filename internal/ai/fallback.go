@@ -0,0 +1,85 @@
+package ai
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Fallback is an Ai that tries each provider in order until one of them returns a non-empty response.
+type Fallback struct {
+	names   []string
+	clients []Ai
+	timeout time.Duration
+	logger  *log.Logger
+}
+
+func (ai *Fallback) GetResponse(ctx context.Context, prompt *Prompt) (string, error) {
+	response, _, err := ai.GetResponseWithProvider(ctx, prompt)
+	return response, err
+}
+
+// GetResponseWithProvider returns the response and the name of the provider that answered.
+// Each provider gets its own timeout, and no further provider is tried once ctx is done.
+func (ai *Fallback) GetResponseWithProvider(ctx context.Context, prompt *Prompt) (string, string, error) {
+	var errs []error
+	for i, client := range ai.clients {
+		if ctx.Err() != nil {
+			errs = append(errs, ctx.Err())
+			break
+		}
+		name := ai.names[i]
+		response, err := ai.getResponse(ctx, client, prompt)
+		if err == nil && strings.TrimSpace(response) == "" {
+			err = fmt.Errorf("empty response")
+		}
+		if err != nil {
+			ai.logger.Printf("Provider %s failed: %v", name, err)
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+		if i > 0 {
+			ai.logger.Printf("Fell back to provider %s", name)
+		}
+		return response, name, nil
+	}
+	return "", "", fmt.Errorf("all providers failed: %w", errors.Join(errs...))
+}
+
+// getResponse calls the provider and gives up after the timeout, if any
+func (ai *Fallback) getResponse(ctx context.Context, client Ai, prompt *Prompt) (string, error) {
+	if ai.timeout <= 0 {
+		return client.GetResponse(ctx, prompt)
+	}
+	ctx, cancel := context.WithTimeout(ctx, ai.timeout)
+	defer cancel()
+	return client.GetResponse(ctx, prompt)
+}
+
+// NewFallbackClient creates an Ai that tries the clients in order. names[i] is the provider name of clients[i].
+// A timeout of 0 means that each provider is waited for indefinitely.
+func NewFallbackClient(names []string, clients []Ai, timeout time.Duration) (*Fallback, error) {
+	if len(names) != len(clients) {
+		return nil, fmt.Errorf("got %d provider names for %d clients", len(names), len(clients))
+	}
+	if len(clients) == 0 {
+		return nil, fmt.Errorf("at least one provider is required")
+	}
+
+	// Initialize a logger
+	logger := log.New(
+		os.Stdout, "[alert-menta ai] ",
+		log.Ldate|log.Ltime|log.Llongfile|log.Lmsgprefix,
+	)
+
+	return &Fallback{
+		names:   names,
+		clients: clients,
+		timeout: timeout,
+		logger:  logger,
+	}, nil
+}
@@ -0,0 +1,110 @@
+package ai
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// mockAi is an Ai that returns a fixed response after an optional delay
+type mockAi struct {
+	response string
+	err      error
+	delay    time.Duration
+}
+
+func (m *mockAi) GetResponse(ctx context.Context, prompt *Prompt) (string, error) {
+	select {
+	case <-time.After(m.delay):
+		return m.response, m.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// TestFallbackGetResponse tests that providers are tried in order on errors, empty responses and timeouts
+func TestFallbackGetResponse(t *testing.T) {
+	tests := []struct {
+		name             string
+		clients          []Ai
+		expectErr        bool
+		expectedResponse string
+		expectedProvider string
+	}{
+		{
+			name:             "Primary succeeds",
+			clients:          []Ai{&mockAi{response: "primary"}, &mockAi{response: "secondary"}},
+			expectedResponse: "primary",
+			expectedProvider: "first",
+		},
+		{
+			name:             "Primary returns an error",
+			clients:          []Ai{&mockAi{err: errors.New("503 Service Unavailable")}, &mockAi{response: "secondary"}},
+			expectedResponse: "secondary",
+			expectedProvider: "second",
+		},
+		{
+			name:             "Primary returns an empty response",
+			clients:          []Ai{&mockAi{response: " \n"}, &mockAi{response: "secondary"}},
+			expectedResponse: "secondary",
+			expectedProvider: "second",
+		},
+		{
+			name:             "Primary times out",
+			clients:          []Ai{&mockAi{response: "primary", delay: time.Second}, &mockAi{response: "secondary"}},
+			expectedResponse: "secondary",
+			expectedProvider: "second",
+		},
+		{
+			name:      "All providers fail",
+			clients:   []Ai{&mockAi{err: errors.New("error")}, &mockAi{response: ""}},
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			aic, err := NewFallbackClient([]string{"first", "second"}, tt.clients, 100*time.Millisecond)
+			if err != nil {
+				t.Fatalf("NewFallbackClient returned an error: %v", err)
+			}
+			response, provider, err := aic.GetResponseWithProvider(context.Background(), &Prompt{UserPrompt: "user"})
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("expected error: %v, got %v", tt.expectErr, err)
+			}
+			if response != tt.expectedResponse {
+				t.Errorf("expected response '%s', got '%s'", tt.expectedResponse, response)
+			}
+			if provider != tt.expectedProvider {
+				t.Errorf("expected provider '%s', got '%s'", tt.expectedProvider, provider)
+			}
+		})
+	}
+}
+
+// TestFallbackGetResponseCanceled tests that no further provider is tried once the context is canceled
+func TestFallbackGetResponseCanceled(t *testing.T) {
+	secondary := &mockAi{response: "secondary"}
+	aic, err := NewFallbackClient([]string{"first", "second"}, []Ai{&mockAi{response: "primary", delay: time.Second}, secondary}, 0)
+	if err != nil {
+		t.Fatalf("NewFallbackClient returned an error: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, _, err = aic.GetResponseWithProvider(ctx, &Prompt{UserPrompt: "user"})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+// TestNewFallbackClient tests the argument validation of NewFallbackClient
+func TestNewFallbackClient(t *testing.T) {
+	if _, err := NewFallbackClient([]string{"first"}, []Ai{}, 0); err == nil {
+		t.Error("expected an error for mismatched names and clients")
+	}
+	if _, err := NewFallbackClient([]string{}, []Ai{}, 0); err == nil {
+		t.Error("expected an error for no clients")
+	}
+}
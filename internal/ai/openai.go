@@ -3,25 +3,69 @@ package ai
 import (
 	"context"
 	"fmt"
+	"net/http"
+	"strings"
 
 	"github.com/3-shake/alert-menta/internal/utils"
 	"github.com/Azure/azure-sdk-for-go/sdk/ai/azopenai"
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
 )
 
+const openAIBaseURL = "https://api.openai.com/v1/"
+
 type OpenAI struct {
-	apiKey string
-	model  string
+	apiKey  string
+	model   string
+	baseURL string
+	headers map[string]string
+}
+
+// openAIHeaderPolicy adds the configured extra headers to every request.
+// When no API key is configured, the Authorization header is removed so that
+// endpoints without authentication (e.g. a local Ollama) do not receive an empty bearer token.
+type openAIHeaderPolicy struct {
+	headers map[string]string
+	noAuth  bool
+}
+
+func (p *openAIHeaderPolicy) Do(req *policy.Request) (*http.Response, error) {
+	for k, v := range p.headers {
+		req.Raw().Header.Set(k, v)
+	}
+	if p.noAuth {
+		req.Raw().Header.Del("Authorization")
+	}
+	return req.Next()
 }
 
-func (ai *OpenAI) GetResponse(prompt *Prompt) (string, error) {
+func (ai *OpenAI) GetResponse(ctx context.Context, prompt *Prompt) (string, error) {
 	// Create a new OpenAI client
 	keyCredential := azcore.NewKeyCredential(ai.apiKey)
-	client, err := azopenai.NewClientForOpenAI("https://api.openai.com/v1/", keyCredential, nil)
+	options := &azopenai.ClientOptions{
+		ClientOptions: azcore.ClientOptions{
+			// Runs after the key credential policy so that the Authorization header can be removed
+			PerRetryPolicies: []policy.Policy{&openAIHeaderPolicy{headers: ai.headers, noAuth: ai.apiKey == ""}},
+			// Self-hosted endpoints are often served over plain HTTP inside the cluster
+			InsecureAllowCredentialWithHTTP: strings.HasPrefix(ai.baseURL, "http://"),
+			// Retries are handled by Retry, so that all providers share the same policy
+			Retry: policy.RetryOptions{MaxRetries: -1},
+		},
+	}
+	client, err := azopenai.NewClientForOpenAI(ai.baseURL, keyCredential, options)
 	if err != nil {
 		return "", fmt.Errorf("failed to create OpenAI client: %w", err)
 	}
 
+	// OpenAI-compatible servers may not know max_completion_tokens
+	return getChatCompletion(ctx, client, ai.model, prompt, ai.baseURL != openAIBaseURL)
+}
+
+// getChatCompletion sends the prompt to the Chat Completions API. It is shared by OpenAI and Azure OpenAI,
+// where deploymentName is the model name and the deployment name respectively.
+// The response length is limited with max_completion_tokens, which reasoning models require, or with max_tokens if legacyMaxTokens is true.
+func getChatCompletion(ctx context.Context, client *azopenai.Client, deploymentName string, prompt *Prompt, legacyMaxTokens bool) (string, error) {
 	// Convert images to base64
 	base64Images := func(images []Image) []string {
 		var base64Images []string
@@ -35,7 +79,11 @@ func (ai *OpenAI) GetResponse(prompt *Prompt) (string, error) {
 	userPrompt := []azopenai.ChatCompletionRequestMessageContentPartClassification{
 		&azopenai.ChatCompletionRequestMessageContentPartText{Text: &prompt.UserPrompt},
 	}
-	for _, image := range base64Images {
+	for i, image := range base64Images {
+		// The label tells the model where the image came from
+		if label := prompt.Images[i].Label; label != "" {
+			userPrompt = append(userPrompt, &azopenai.ChatCompletionRequestMessageContentPartText{Text: &label})
+		}
 		userPrompt = append(userPrompt, &azopenai.ChatCompletionRequestMessageContentPartImage{ImageURL: &azopenai.ChatCompletionRequestMessageContentPartImageURL{URL: &image}})
 	}
 
@@ -49,26 +97,60 @@ func (ai *OpenAI) GetResponse(prompt *Prompt) (string, error) {
 		},
 	}
 
-	// Call the chat completion endpoint
-	resp, err := client.GetChatCompletions(context.TODO(), azopenai.ChatCompletionsOptions{
-		DeploymentName: &ai.model,
+	options := azopenai.ChatCompletionsOptions{
+		DeploymentName: &deploymentName,
 		Messages:       messages,
-	}, nil)
+		Seed:           prompt.Params.Seed,
+	}
+	if t := prompt.Params.Temperature; t != nil {
+		options.Temperature = to.Ptr(float32(*t))
+	}
+	if p := prompt.Params.TopP; p != nil {
+		options.TopP = to.Ptr(float32(*p))
+	}
+	if prompt.Params.MaxTokens > 0 {
+		if legacyMaxTokens {
+			options.MaxTokens = to.Ptr(int32(prompt.Params.MaxTokens))
+		} else {
+			options.MaxCompletionTokens = to.Ptr(int32(prompt.Params.MaxTokens))
+		}
+	}
+
+	// Call the chat completion endpoint
+	resp, err := client.GetChatCompletions(ctx, options, nil)
 	if err != nil {
 		return "", fmt.Errorf("ChatCompletion error: %w", err)
 	}
 
-	// Print the response
-	// resp.Choices[0].Message.Content is type *string with azopenai and type string with go-openai
-	// fmt.Println(*resp.Choices[0].Message.Content)
+	// OpenAI-compatible servers may reply without choices, and Azure content filtering without content.
+	// Return an error instead of panicking, so that a fallback provider can answer.
+	if len(resp.Choices) == 0 {
+		return "", fmt.Errorf("ChatCompletion error: no choices in the response")
+	}
+	choice := resp.Choices[0]
+	if choice.Message == nil || choice.Message.Content == nil {
+		finishReason := "unknown"
+		if choice.FinishReason != nil {
+			finishReason = string(*choice.FinishReason)
+		}
+		return "", fmt.Errorf("ChatCompletion error: no content in the response (finish reason: %s)", finishReason)
+	}
 
-	return *resp.Choices[0].Message.Content, nil
+	return *choice.Message.Content, nil
 }
 
 func NewOpenAIClient(apiKey string, model string) *OpenAI {
+	return NewOpenAICompatibleClient(openAIBaseURL, apiKey, model, nil)
+}
+
+// NewOpenAICompatibleClient creates a client for an endpoint that implements the OpenAI Chat Completions API,
+// such as vLLM, Ollama or LiteLLM. apiKey may be empty for endpoints without authentication.
+func NewOpenAICompatibleClient(baseURL string, apiKey string, model string, headers map[string]string) *OpenAI {
 	// Specifying the model to use
 	return &OpenAI{
-		apiKey: apiKey,
-		model:  model,
+		apiKey:  apiKey,
+		model:   model,
+		baseURL: baseURL,
+		headers: headers,
 	}
 }
@@ -0,0 +1,138 @@
+package ai
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const openAITestResponse = `{"id":"chatcmpl-test","object":"chat.completion","created":0,"model":"test-model",` +
+	`"choices":[{"index":0,"finish_reason":"stop","message":{"role":"assistant","content":"Hello from a local model"}}]}`
+
+// TestOpenAICompatibleGetResponse tests that requests go to the configured base URL with the extra headers
+func TestOpenAICompatibleGetResponse(t *testing.T) {
+	tests := []struct {
+		name       string
+		apiKey     string
+		expectAuth string
+	}{
+		{"With API key", "test-key", "Bearer test-key"},
+		{"Without API key", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/v1/chat/completions" {
+					t.Errorf("expected path /v1/chat/completions, got %s", r.URL.Path)
+				}
+				if r.Header.Get("Authorization") != tt.expectAuth {
+					t.Errorf("expected Authorization '%s', got '%s'", tt.expectAuth, r.Header.Get("Authorization"))
+				}
+				if r.Header.Get("X-Tenant") != "sre" {
+					t.Errorf("expected X-Tenant header 'sre', got '%s'", r.Header.Get("X-Tenant"))
+				}
+				var body map[string]any
+				if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+					t.Fatalf("Error decoding request: %v", err)
+				}
+				if body["model"] != "test-model" {
+					t.Errorf("expected model 'test-model', got '%v'", body["model"])
+				}
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write([]byte(openAITestResponse))
+			}))
+			defer server.Close()
+
+			aic := NewOpenAICompatibleClient(server.URL+"/v1", tt.apiKey, "test-model", map[string]string{"X-Tenant": "sre"})
+			resp, err := aic.GetResponse(context.Background(), &Prompt{SystemPrompt: "system", UserPrompt: "user"})
+			if err != nil {
+				t.Fatalf("GetResponse returned an error: %v", err)
+			}
+			if resp != "Hello from a local model" {
+				t.Errorf("expected response 'Hello from a local model', got '%s'", resp)
+			}
+		})
+	}
+}
+
+// TestOpenAICompatibleEmptyResponse tests that replies without choices or content return an error instead of panicking
+func TestOpenAICompatibleEmptyResponse(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+	}{
+		{"No choices", `{"id":"chatcmpl-test","object":"chat.completion","created":0,"model":"test-model","choices":[]}`},
+		{"No content", `{"id":"chatcmpl-test","object":"chat.completion","created":0,"model":"test-model",` +
+			`"choices":[{"index":0,"finish_reason":"content_filter","message":{"role":"assistant"}}]}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write([]byte(tt.response))
+			}))
+			defer server.Close()
+
+			aic := NewOpenAICompatibleClient(server.URL+"/v1", "test-key", "test-model", nil)
+			if _, err := aic.GetResponse(context.Background(), &Prompt{SystemPrompt: "system", UserPrompt: "user"}); err == nil {
+				t.Error("expected an error, got nil")
+			}
+		})
+	}
+}
+
+// TestChatCompletionParams tests that the generation parameters are sent only when they are set,
+// and that the response length is limited with max_tokens on OpenAI-compatible endpoints
+func TestChatCompletionParams(t *testing.T) {
+	temperature, topP, seed := 0.2, 0.9, int64(7)
+	params := Params{Temperature: &temperature, TopP: &topP, MaxTokens: 100, Seed: &seed}
+	tests := []struct {
+		name       string
+		azure      bool
+		apiVersion string
+		params     Params
+		expected   map[string]any
+	}{
+		{"Compatible endpoint", false, "", params, map[string]any{"temperature": 0.2, "top_p": 0.9, "max_tokens": 100.0, "seed": 7.0}},
+		{"Azure OpenAI", true, "", params, map[string]any{"temperature": 0.2, "top_p": 0.9, "max_completion_tokens": 100.0, "seed": 7.0}},
+		{"Azure OpenAI preview", true, "2024-09-01-preview", params, map[string]any{"temperature": 0.2, "top_p": 0.9, "max_completion_tokens": 100.0, "seed": 7.0}},
+		{"Azure OpenAI before max_completion_tokens", true, "2024-06-01", params, map[string]any{"temperature": 0.2, "top_p": 0.9, "max_tokens": 100.0, "seed": 7.0}},
+		{"Unset", false, "", Params{}, map[string]any{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body map[string]any
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+					t.Fatalf("Error decoding request: %v", err)
+				}
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write([]byte(openAITestResponse))
+			}))
+			defer server.Close()
+
+			var aic Ai = NewOpenAICompatibleClient(server.URL+"/v1", "test-key", "test-model", nil)
+			if tt.azure {
+				var err error
+				if aic, err = NewAzureOpenAIClient(server.URL, "my-deployment", tt.apiVersion, "test-key"); err != nil {
+					t.Fatalf("NewAzureOpenAIClient returned an error: %v", err)
+				}
+			}
+			if _, err := aic.GetResponse(context.Background(), &Prompt{SystemPrompt: "system", UserPrompt: "user", Params: tt.params}); err != nil {
+				t.Fatalf("GetResponse returned an error: %v", err)
+			}
+			for _, key := range []string{"temperature", "top_p", "max_tokens", "max_completion_tokens", "seed"} {
+				expected, ok := tt.expected[key]
+				got, sent := body[key]
+				if ok != sent || (ok && got != expected) {
+					t.Errorf("%s: expected %v (sent: %v), got %v (sent: %v)", key, expected, ok, got, sent)
+				}
+			}
+		})
+	}
+}
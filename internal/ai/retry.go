@@ -0,0 +1,187 @@
+package ai
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultMaxAttempts = 3
+	defaultBaseDelay   = 2 * time.Second
+	defaultMaxDelay    = 30 * time.Second
+	defaultJitter      = 0.2
+)
+
+// RetryPolicy defines how failed LLM calls are retried.
+type RetryPolicy struct {
+	// Total number of attempts, including the first one. 1 disables retries.
+	MaxAttempts int
+	// Delay before the first retry. It is doubled for each subsequent retry.
+	BaseDelay time.Duration
+	// Upper limit of the delay, including the delay requested by Retry-After
+	MaxDelay time.Duration
+	// Fraction of the delay that is added at random (0-1), so that concurrent runs do not retry at the same time
+	Jitter float64
+	// Use the backoff delay even if the server sends Retry-After
+	IgnoreRetryAfter bool
+}
+
+// DefaultRetryPolicy returns the policy used when no retry settings are configured.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: defaultMaxAttempts,
+		BaseDelay:   defaultBaseDelay,
+		MaxDelay:    defaultMaxDelay,
+		Jitter:      defaultJitter,
+	}
+}
+
+// Retry is an Ai that retries rate limit (429) and server (5xx) errors of the wrapped Ai.
+type Retry struct {
+	client Ai
+	policy RetryPolicy
+	logger *log.Logger
+	sleep  func(context.Context, time.Duration) error
+}
+
+// APIError is returned by providers that call their HTTP API directly.
+type APIError struct {
+	StatusCode int
+	Header     http.Header
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+func (ai *Retry) GetResponse(ctx context.Context, prompt *Prompt) (string, error) {
+	var err error
+	for attempt := 1; ; attempt++ {
+		var response string
+		response, err = ai.client.GetResponse(ctx, prompt)
+		if err == nil {
+			return response, nil
+		}
+
+		// A canceled or timed out call is not retried
+		retryable, retryAfter := classifyError(err)
+		if !retryable || ctx.Err() != nil || attempt >= ai.policy.MaxAttempts {
+			break
+		}
+
+		delay := ai.policy.delay(attempt, retryAfter)
+		ai.logger.Printf("Attempt %d/%d failed, retrying in %s: %v", attempt, ai.policy.MaxAttempts, delay, err)
+		if sleepErr := ai.sleep(ctx, delay); sleepErr != nil {
+			return "", fmt.Errorf("%w (retry canceled: %w)", err, sleepErr)
+		}
+	}
+	return "", err
+}
+
+// sleep waits for the delay, returning early if ctx is done
+func sleep(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// delay returns the time to wait before the next attempt
+func (p RetryPolicy) delay(attempt int, retryAfter time.Duration) time.Duration {
+	if retryAfter > 0 && !p.IgnoreRetryAfter {
+		return min(retryAfter, p.MaxDelay)
+	}
+
+	delay := p.BaseDelay << (attempt - 1)
+	if delay <= 0 || delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if p.Jitter > 0 {
+		delay += time.Duration(rand.Float64() * p.Jitter * float64(delay)) //nolint:gosec // jitter does not need a secure random number
+	}
+	return delay
+}
+
+// classifyError reports whether err is worth retrying and the delay requested by the server, if any.
+func classifyError(err error) (bool, time.Duration) {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return isRetryableStatus(apiErr.StatusCode), parseRetryAfter(apiErr.Header.Get("Retry-After"))
+	}
+
+	// OpenAI and Azure OpenAI
+	var respErr *azcore.ResponseError
+	if errors.As(err, &respErr) {
+		var retryAfter time.Duration
+		if respErr.RawResponse != nil {
+			retryAfter = parseRetryAfter(respErr.RawResponse.Header.Get("Retry-After"))
+		}
+		return isRetryableStatus(respErr.StatusCode), retryAfter
+	}
+
+	// Vertex AI returns gRPC errors
+	if s, ok := status.FromError(err); ok {
+		switch s.Code() {
+		case codes.ResourceExhausted, codes.Unavailable, codes.Internal, codes.DeadlineExceeded:
+			return true, 0
+		}
+	}
+	return false, 0
+}
+
+func isRetryableStatus(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode >= http.StatusInternalServerError
+}
+
+// parseRetryAfter parses the Retry-After header, which is either a number of seconds or an HTTP date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+// NewRetryClient wraps client so that its calls are retried according to policy.
+func NewRetryClient(client Ai, policy RetryPolicy) (*Retry, error) {
+	if policy.MaxAttempts < 1 {
+		return nil, fmt.Errorf("max attempts must be at least 1, got %d", policy.MaxAttempts)
+	}
+	if policy.Jitter < 0 || policy.Jitter > 1 {
+		return nil, fmt.Errorf("jitter must be between 0 and 1, got %g", policy.Jitter)
+	}
+
+	// Initialize a logger
+	logger := log.New(
+		os.Stdout, "[alert-menta ai] ",
+		log.Ldate|log.Ltime|log.Llongfile|log.Lmsgprefix,
+	)
+
+	return &Retry{
+		client: client,
+		policy: policy,
+		logger: logger,
+		sleep:  sleep,
+	}, nil
+}
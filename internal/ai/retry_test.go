@@ -0,0 +1,238 @@
+package ai
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// scriptedResponse is a response returned by the fake server
+type scriptedResponse struct {
+	status     int
+	retryAfter string
+	body       string
+}
+
+// newScriptedServer returns a server that returns the responses in order, and a pointer to the number of requests
+func newScriptedServer(t *testing.T, responses []scriptedResponse) (*httptest.Server, *int) {
+	t.Helper()
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests >= len(responses) {
+			t.Errorf("unexpected request #%d", requests+1)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		resp := responses[requests]
+		requests++
+		if resp.retryAfter != "" {
+			w.Header().Set("Retry-After", resp.retryAfter)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(resp.status)
+		_, _ = w.Write([]byte(resp.body))
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+// newTestRetryClient returns a Retry that records the delays instead of sleeping
+func newTestRetryClient(t *testing.T, client Ai, policy RetryPolicy) (*Retry, *[]time.Duration) {
+	t.Helper()
+	aic, err := NewRetryClient(client, policy)
+	if err != nil {
+		t.Fatalf("NewRetryClient returned an error: %v", err)
+	}
+	var delays []time.Duration
+	aic.sleep = func(ctx context.Context, d time.Duration) error {
+		delays = append(delays, d)
+		return nil
+	}
+	return aic, &delays
+}
+
+const anthropicTestResponse = `{"content":[{"type":"text","text":"ok"}]}`
+
+// TestRetryGetResponse tests retries against a fake server that returns scripted failures
+func TestRetryGetResponse(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Second, MaxDelay: 10 * time.Second}
+
+	tests := []struct {
+		name             string
+		responses        []scriptedResponse
+		policy           RetryPolicy
+		expectErr        bool
+		expectedRequests int
+		expectedDelays   []time.Duration
+	}{
+		{
+			name: "Retries 429 and 5xx with exponential backoff",
+			responses: []scriptedResponse{
+				{status: http.StatusTooManyRequests},
+				{status: http.StatusServiceUnavailable},
+				{status: http.StatusOK, body: anthropicTestResponse},
+			},
+			policy:           policy,
+			expectedRequests: 3,
+			expectedDelays:   []time.Duration{time.Second, 2 * time.Second},
+		},
+		{
+			name: "Honors Retry-After",
+			responses: []scriptedResponse{
+				{status: http.StatusTooManyRequests, retryAfter: "5"},
+				{status: http.StatusOK, body: anthropicTestResponse},
+			},
+			policy:           policy,
+			expectedRequests: 2,
+			expectedDelays:   []time.Duration{5 * time.Second},
+		},
+		{
+			name: "Caps Retry-After at the max delay",
+			responses: []scriptedResponse{
+				{status: http.StatusTooManyRequests, retryAfter: "120"},
+				{status: http.StatusOK, body: anthropicTestResponse},
+			},
+			policy:           policy,
+			expectedRequests: 2,
+			expectedDelays:   []time.Duration{10 * time.Second},
+		},
+		{
+			name: "Ignores Retry-After when configured",
+			responses: []scriptedResponse{
+				{status: http.StatusTooManyRequests, retryAfter: "5"},
+				{status: http.StatusOK, body: anthropicTestResponse},
+			},
+			policy:           RetryPolicy{MaxAttempts: 3, BaseDelay: time.Second, MaxDelay: 10 * time.Second, IgnoreRetryAfter: true},
+			expectedRequests: 2,
+			expectedDelays:   []time.Duration{time.Second},
+		},
+		{
+			name: "Gives up after max attempts",
+			responses: []scriptedResponse{
+				{status: http.StatusInternalServerError},
+				{status: http.StatusInternalServerError},
+				{status: http.StatusInternalServerError},
+			},
+			policy:           policy,
+			expectErr:        true,
+			expectedRequests: 3,
+			expectedDelays:   []time.Duration{time.Second, 2 * time.Second},
+		},
+		{
+			name: "Does not retry client errors",
+			responses: []scriptedResponse{
+				{status: http.StatusBadRequest},
+			},
+			policy:           policy,
+			expectErr:        true,
+			expectedRequests: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, requests := newScriptedServer(t, tt.responses)
+			aic, delays := newTestRetryClient(t, newTestAnthropicClient(server.URL), tt.policy)
+
+			_, err := aic.GetResponse(context.Background(), &Prompt{UserPrompt: "user"})
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("expected error: %v, got %v", tt.expectErr, err)
+			}
+			if *requests != tt.expectedRequests {
+				t.Errorf("expected %d requests, got %d", tt.expectedRequests, *requests)
+			}
+			if len(*delays) != len(tt.expectedDelays) {
+				t.Fatalf("expected delays %v, got %v", tt.expectedDelays, *delays)
+			}
+			for i, d := range tt.expectedDelays {
+				if (*delays)[i] != d {
+					t.Errorf("expected delay %s, got %s", d, (*delays)[i])
+				}
+			}
+		})
+	}
+}
+
+// TestRetryGetResponseOpenAI tests that errors of the azopenai client are retried
+func TestRetryGetResponseOpenAI(t *testing.T) {
+	server, requests := newScriptedServer(t, []scriptedResponse{
+		{status: http.StatusTooManyRequests, retryAfter: "1", body: `{"error":{"message":"rate limited"}}`},
+		{status: http.StatusOK, body: openAITestResponse},
+	})
+	aic, delays := newTestRetryClient(t, NewOpenAICompatibleClient(server.URL, "test-key", "test-model", nil), DefaultRetryPolicy())
+
+	resp, err := aic.GetResponse(context.Background(), &Prompt{UserPrompt: "user"})
+	if err != nil {
+		t.Fatalf("GetResponse returned an error: %v", err)
+	}
+	if resp != "Hello from a local model" {
+		t.Errorf("expected response 'Hello from a local model', got '%s'", resp)
+	}
+	if *requests != 2 {
+		t.Errorf("expected 2 requests, got %d", *requests)
+	}
+	if len(*delays) != 1 || (*delays)[0] != time.Second {
+		t.Errorf("expected delays [1s], got %v", *delays)
+	}
+}
+
+// TestRetryGetResponseCanceled tests that waiting for the next attempt stops when the context is canceled
+func TestRetryGetResponseCanceled(t *testing.T) {
+	server, requests := newScriptedServer(t, []scriptedResponse{
+		{status: http.StatusTooManyRequests, retryAfter: "10"},
+	})
+	aic, err := NewRetryClient(newTestAnthropicClient(server.URL), RetryPolicy{MaxAttempts: 3, BaseDelay: time.Second, MaxDelay: 10 * time.Second})
+	if err != nil {
+		t.Fatalf("NewRetryClient returned an error: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = aic.GetResponse(ctx, &Prompt{UserPrompt: "user"})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected to return when the context is done, took %s", elapsed)
+	}
+	if *requests != 1 {
+		t.Errorf("expected 1 request, got %d", *requests)
+	}
+}
+
+// TestClassifyError tests the classification of gRPC errors returned by Vertex AI
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		err       error
+		retryable bool
+	}{
+		{status.Error(codes.ResourceExhausted, "quota exceeded"), true},
+		{status.Error(codes.Unavailable, "unavailable"), true},
+		{status.Error(codes.InvalidArgument, "invalid"), false},
+		{errors.New("unknown"), false},
+	}
+
+	for _, tt := range tests {
+		retryable, _ := classifyError(tt.err)
+		if retryable != tt.retryable {
+			t.Errorf("expected retryable %v for %v, got %v", tt.retryable, tt.err, retryable)
+		}
+	}
+}
+
+// TestNewRetryClient tests the validation of the retry policy
+func TestNewRetryClient(t *testing.T) {
+	if _, err := NewRetryClient(&mockAi{}, RetryPolicy{MaxAttempts: 0}); err == nil {
+		t.Error("expected an error for max attempts 0")
+	}
+	if _, err := NewRetryClient(&mockAi{}, RetryPolicy{MaxAttempts: 1, Jitter: 2}); err == nil {
+		t.Error("expected an error for jitter 2")
+	}
+}
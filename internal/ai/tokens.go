@@ -0,0 +1,118 @@
+package ai
+
+import (
+	"math"
+	"strings"
+	"unicode/utf8"
+)
+
+// Tokens reserved for the note that tells the model that comments were omitted
+const omittedNoteTokens = 20
+
+// Average number of ASCII characters per token for each model family.
+// The values are deliberately on the low side, so that the estimate errs towards more tokens.
+var charsPerToken = []struct {
+	prefix string
+	chars  float64
+}{
+	{"gpt-4o", 4.0},
+	{"gpt-4.1", 4.0},
+	{"gpt-5", 4.0},
+	{"o1", 4.0},
+	{"o3", 4.0},
+	{"o4", 4.0},
+	{"gpt-", 3.7},
+	{"claude", 3.5},
+	{"gemini", 4.0},
+}
+
+// Used for unknown models, such as self-hosted ones
+const defaultCharsPerToken = 3.0
+
+func modelCharsPerToken(model string) float64 {
+	model = strings.ToLower(model)
+	for _, c := range charsPerToken {
+		if strings.HasPrefix(model, c.prefix) {
+			return c.chars
+		}
+	}
+	return defaultCharsPerToken
+}
+
+// EstimateTokens estimates the number of tokens of text for the model without calling the provider.
+// Non-ASCII characters, e.g. Japanese, are counted as one token each.
+func EstimateTokens(model, text string) int {
+	ascii, other := 0, 0
+	for _, r := range text {
+		if r < utf8.RuneSelf {
+			ascii++
+		} else {
+			other++
+		}
+	}
+	return int(math.Ceil(float64(ascii)/modelCharsPerToken(model))) + other
+}
+
+// MostTokensModel returns the model for which EstimateTokens gives the highest estimate, so that a budget
+// computed with it holds for every model, e.g. all providers of a fallback chain.
+func MostTokensModel(models []string) string {
+	var result string
+	for i, model := range models {
+		if i == 0 || modelCharsPerToken(model) < modelCharsPerToken(result) {
+			result = model
+		}
+	}
+	return result
+}
+
+// TruncateText cuts text so that it fits in budget tokens.
+func TruncateText(model, text string, budget int) string {
+	if budget <= 0 {
+		return ""
+	}
+	if EstimateTokens(model, text) <= budget {
+		return text
+	}
+	// Binary search for the longest prefix that fits, in runes so that multi-byte characters are not split
+	runes := []rune(text)
+	lo, hi := 0, len(runes)
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		if EstimateTokens(model, string(runes[:mid])) <= budget {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	return string(runes[:lo])
+}
+
+// FitComments returns the number of oldest comments to drop so that head and the remaining newest comments fit in budget tokens.
+// When comments are dropped, room is left for a note about the omission. A budget of 0 or less means no limit.
+func FitComments(model string, budget int, head string, comments []string) int {
+	if budget <= 0 {
+		return 0
+	}
+
+	used := EstimateTokens(model, head)
+	total := used
+	for _, c := range comments {
+		total += EstimateTokens(model, c)
+	}
+	if total <= budget {
+		return 0
+	}
+
+	// Keep the newest comments that fit
+	used += omittedNoteTokens
+	first := len(comments)
+	for first > 0 {
+		tokens := EstimateTokens(model, comments[first-1])
+		if used+tokens > budget {
+			break
+		}
+		used += tokens
+		first--
+	}
+	return first
+}
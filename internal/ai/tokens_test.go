@@ -0,0 +1,78 @@
+package ai
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestEstimateTokens tests the estimate for each model family
+func TestEstimateTokens(t *testing.T) {
+	tests := []struct {
+		model    string
+		text     string
+		expected int
+	}{
+		{"gpt-4o-mini", strings.Repeat("a", 400), 100},
+		{"claude-sonnet-4-5", strings.Repeat("a", 350), 100},
+		{"gemini-2.0-flash-001", strings.Repeat("a", 400), 100},
+		{"llama3", strings.Repeat("a", 300), 100},
+		{"gpt-4o-mini", "障害が発生しました", 9},
+		{"gpt-4o-mini", "", 0},
+	}
+
+	for _, tt := range tests {
+		if got := EstimateTokens(tt.model, tt.text); got != tt.expected {
+			t.Errorf("EstimateTokens(%s, %q): expected %d, got %d", tt.model, tt.text, tt.expected, got)
+		}
+	}
+}
+
+// TestMostTokensModel tests that the model with the fewest characters per token is chosen
+func TestMostTokensModel(t *testing.T) {
+	if got := MostTokensModel([]string{"gpt-4o", "claude-sonnet-4-5", "gemini-2.0-flash-001"}); got != "claude-sonnet-4-5" {
+		t.Errorf("expected 'claude-sonnet-4-5', got %q", got)
+	}
+	if got := MostTokensModel([]string{"gpt-4o", "llama3"}); got != "llama3" {
+		t.Errorf("expected 'llama3', got %q", got)
+	}
+}
+
+// TestTruncateText tests that text is cut to the budget without splitting multi-byte characters
+func TestTruncateText(t *testing.T) {
+	if got := TruncateText("gpt-4o", "short", 10); got != "short" {
+		t.Errorf("expected text within the budget to be unchanged, got %q", got)
+	}
+	if got := TruncateText("gpt-4o", strings.Repeat("a", 100), 10); got != strings.Repeat("a", 40) {
+		t.Errorf("expected 40 characters, got %q", got)
+	}
+	if got := TruncateText("gpt-4o", "障害が発生しました", 3); got != "障害が" {
+		t.Errorf("expected '障害が', got %q", got)
+	}
+}
+
+// TestFitComments tests that the oldest comments are dropped first
+func TestFitComments(t *testing.T) {
+	head := strings.Repeat("h", 40)    // 10 tokens
+	comment := strings.Repeat("c", 40) // 10 tokens each
+	comments := []string{comment, comment, comment, comment, comment, comment}
+
+	tests := []struct {
+		name     string
+		budget   int
+		expected int
+	}{
+		{"No limit", 0, 0},
+		{"Everything fits", 70, 0},
+		// 10 (head) + 20 (note) leaves room for two comments
+		{"Keeps the newest comments", 50, 4},
+		{"Drops all comments", 35, 6},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := FitComments("gpt-4o", tt.budget, head, comments); got != tt.expected {
+				t.Errorf("expected to drop %d comments, got %d", tt.expected, got)
+			}
+		})
+	}
+}
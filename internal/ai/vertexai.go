@@ -9,24 +9,26 @@ import (
 )
 
 type VertexAI struct {
-	context context.Context
-	client  *genai.Client
-	model   string
+	client *genai.Client
+	model  string
 }
 
-func (ai *VertexAI) GetResponse(prompt *Prompt) (string, error) {
+func (ai *VertexAI) GetResponse(ctx context.Context, prompt *Prompt) (string, error) {
 	model := ai.client.GenerativeModel(ai.model)
-	// Temperature recommended by LLM
-	model.SetTemperature(0.5)
+	setVertexAIParams(&model.GenerationConfig, prompt.Params)
 
 	integratedPrompt := []genai.Part{} // image + text prompt
 	for _, image := range prompt.Images {
+		// The label tells the model where the image came from
+		if image.Label != "" {
+			integratedPrompt = append(integratedPrompt, genai.Text(image.Label))
+		}
 		integratedPrompt = append(integratedPrompt, genai.ImageData(image.Extension, image.Data))
 	}
 	integratedPrompt = append(integratedPrompt, genai.Text(prompt.SystemPrompt+prompt.UserPrompt))
 
 	// Generate AI response
-	resp, err := model.GenerateContent(ai.context, integratedPrompt...)
+	resp, err := model.GenerateContent(ctx, integratedPrompt...)
 	if err != nil {
 		return "", fmt.Errorf("GenerateContent error: %w", err)
 	}
@@ -34,6 +36,24 @@ func (ai *VertexAI) GetResponse(prompt *Prompt) (string, error) {
 	return getResponseText(resp), nil
 }
 
+// Temperature used when the command does not set one, recommended by LLM
+const defaultVertexAITemperature = 0.5
+
+// setVertexAIParams sets the generation parameters of the command. The Gemini API has no seed.
+func setVertexAIParams(config *genai.GenerationConfig, params Params) {
+	temperature := defaultVertexAITemperature
+	if params.Temperature != nil {
+		temperature = *params.Temperature
+	}
+	config.SetTemperature(float32(temperature))
+	if params.TopP != nil {
+		config.SetTopP(float32(*params.TopP))
+	}
+	if params.MaxTokens > 0 {
+		config.SetMaxOutputTokens(int32(params.MaxTokens))
+	}
+}
+
 func getResponseText(resp *genai.GenerateContentResponse) string {
 	result := ""
 	for _, cand := range resp.Candidates {
@@ -46,17 +66,15 @@ func getResponseText(resp *genai.GenerateContentResponse) string {
 	return result
 }
 
-func NewVertexAIClient(projectID, localtion, modelName string) (*VertexAI, error) {
+func NewVertexAIClient(ctx context.Context, projectID, localtion, modelName string) (*VertexAI, error) {
 	// Secret is provided in json and PATH is specified in the environment variable `GOOGLE_APPLICATION_CREDENTIALS`.
 	// If you are using gcloud cli authentication or workload identity federation, you do not need to specify the secret json file.
-	ctx := context.Background()
 	client, err := genai.NewClient(ctx, projectID, localtion)
 	if err != nil {
 		return nil, fmt.Errorf("new client error: %w", err)
 	}
 	return &VertexAI{
-		context: ctx,
-		client:  client,
-		model:   modelName,
+		client: client,
+		model:  modelName,
 	}, nil
 }
@@ -0,0 +1,26 @@
+package ai
+
+import (
+	"testing"
+
+	"cloud.google.com/go/vertexai/genai"
+)
+
+// TestSetVertexAIParams tests that the temperature defaults to 0.5, and that the parameters of the command are set
+func TestSetVertexAIParams(t *testing.T) {
+	var unset genai.GenerationConfig
+	setVertexAIParams(&unset, Params{})
+	if unset.Temperature == nil || *unset.Temperature != 0.5 {
+		t.Errorf("expected the default temperature 0.5, got %v", unset.Temperature)
+	}
+	if unset.TopP != nil || unset.MaxOutputTokens != nil {
+		t.Errorf("expected top_p and max_tokens to be unset, got %v and %v", unset.TopP, unset.MaxOutputTokens)
+	}
+
+	temperature, topP := 0.1, 0.8
+	var set genai.GenerationConfig
+	setVertexAIParams(&set, Params{Temperature: &temperature, TopP: &topP, MaxTokens: 512})
+	if *set.Temperature != 0.1 || *set.TopP != 0.8 || *set.MaxOutputTokens != 512 {
+		t.Errorf("expected temperature 0.1, top_p 0.8 and max_tokens 512, got %v, %v and %v", *set.Temperature, *set.TopP, *set.MaxOutputTokens)
+	}
+}
@@ -0,0 +1,202 @@
+package github
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const defaultAPIBaseURL = "https://api.github.com/"
+
+// Installation tokens are refreshed this long before they expire. They are valid for an hour.
+const installationTokenExpiryDelta = 5 * time.Minute
+
+// App authenticates as a GitHub App installation (https://docs.github.com/en/apps/creating-github-apps/authenticating-with-a-github-app)
+type App struct {
+	appID int64
+	key   *rsa.PrivateKey
+	// Installation ID. 0 means that it is looked up for each repository.
+	installationID int64
+	baseURL        string
+	client         *http.Client
+
+	mu sync.Mutex
+	// Token sources by installation ID, or by "owner/repo" when the installation is looked up
+	sources map[string]oauth2.TokenSource
+	// Login of the bot user, looked up on first use
+	login string
+}
+
+// NewApp creates an App from the app ID and the PEM-encoded private key of the app.
+// If installationID is 0, the installation is looked up from the repository.
+// baseURL is the API endpoint of a GitHub Enterprise Server (see EnterpriseURLs), or empty for github.com.
+func NewApp(appID int64, privateKeyPEM []byte, installationID int64, baseURL string) (*App, error) {
+	if appID <= 0 {
+		return nil, fmt.Errorf("GitHub App ID is required")
+	}
+	key, err := parsePrivateKey(privateKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+	if baseURL == "" {
+		baseURL = defaultAPIBaseURL
+	} else if baseURL, _, err = EnterpriseURLs(baseURL, ""); err != nil {
+		return nil, err
+	}
+	return &App{
+		appID:          appID,
+		key:            key,
+		installationID: installationID,
+		baseURL:        baseURL,
+		client:         &http.Client{Timeout: 30 * time.Second},
+		sources:        make(map[string]oauth2.TokenSource),
+	}, nil
+}
+
+// parsePrivateKey parses the PKCS#1 key that GitHub generates, or a PKCS#8 key
+func parsePrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("GitHub App private key is not PEM encoded")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing GitHub App private key: %w", err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("GitHub App private key is not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+// TokenSource returns a token source for the installation that has access to owner/repo.
+// Tokens are minted on first use and refreshed before they expire.
+func (app *App) TokenSource(owner, repo string) oauth2.TokenSource {
+	key := owner + "/" + repo
+	if app.installationID != 0 {
+		key = strconv.FormatInt(app.installationID, 10)
+	}
+
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	if ts, ok := app.sources[key]; ok {
+		return ts
+	}
+	src := &installationTokenSource{app: app, owner: owner, repo: repo, installationID: app.installationID}
+	ts := oauth2.ReuseTokenSourceWithExpiry(nil, src, installationTokenExpiryDelta)
+	app.sources[key] = ts
+	return ts
+}
+
+// Login returns the login of the bot user that acts for the installations of the app, e.g. "alert-menta[bot]"
+func (app *App) Login(ctx context.Context) (string, error) {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	if app.login == "" {
+		var info struct {
+			Slug string `json:"slug"`
+		}
+		if err := app.do(ctx, http.MethodGet, "/app", &info); err != nil {
+			return "", fmt.Errorf("looking up the GitHub App: %w", err)
+		}
+		app.login = info.Slug + "[bot]"
+	}
+	return app.login, nil
+}
+
+// jwt returns a JSON Web Token that authenticates as the app for 10 minutes, the maximum GitHub allows
+func (app *App) jwt(now time.Time) (string, error) {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims, err := json.Marshal(map[string]any{
+		// Issued 60 seconds in the past to allow for clock drift
+		"iat": now.Add(-60 * time.Second).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": strconv.FormatInt(app.appID, 10),
+	})
+	if err != nil {
+		return "", fmt.Errorf("encoding JWT claims: %w", err)
+	}
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, app.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("signing JWT: %w", err)
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// do sends a request authenticated as the app and decodes the JSON response into v
+func (app *App) do(ctx context.Context, method, path string, v any) error {
+	jwt, err := app.jwt(time.Now())
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(app.baseURL, "/")+path, nil)
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	resp, err := app.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s %s: %w", method, path, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s %s: unexpected status %d: %s", method, path, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("decoding response of %s %s: %w", method, path, err)
+	}
+	return nil
+}
+
+// installationTokenSource mints a new installation token on every call. It is wrapped in oauth2.ReuseTokenSource.
+type installationTokenSource struct {
+	app            *App
+	owner          string
+	repo           string
+	installationID int64
+}
+
+func (s *installationTokenSource) Token() (*oauth2.Token, error) {
+	ctx := context.Background()
+	if s.installationID == 0 {
+		var installation struct {
+			ID int64 `json:"id"`
+		}
+		if err := s.app.do(ctx, http.MethodGet, fmt.Sprintf("/repos/%s/%s/installation", s.owner, s.repo), &installation); err != nil {
+			return nil, fmt.Errorf("looking up the GitHub App installation of %s/%s: %w", s.owner, s.repo, err)
+		}
+		s.installationID = installation.ID
+	}
+
+	var token struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if err := s.app.do(ctx, http.MethodPost, fmt.Sprintf("/app/installations/%d/access_tokens", s.installationID), &token); err != nil {
+		return nil, fmt.Errorf("creating an installation token: %w", err)
+	}
+	return &oauth2.Token{AccessToken: token.Token, TokenType: "Bearer", Expiry: token.ExpiresAt}, nil
+}
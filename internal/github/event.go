@@ -0,0 +1,138 @@
+package github
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Event holds what alert-menta needs from a GitHub Actions event payload
+type Event struct {
+	// Name of the event, e.g. "issue_comment"
+	Name string
+	// Activity that triggered the event, e.g. "created"
+	Action string
+	Owner  string
+	Repo   string
+	// Number of the Issue or pull request
+	Number        int
+	IsPullRequest bool
+	// ID and body of the comment. Empty for events other than issue_comment.
+	CommentID   int64
+	CommentBody string
+	// Association of the comment author, or of the Issue or pull request author, with the repository, e.g. "MEMBER"
+	AuthorAssociation string
+	// Login of the comment author, or of the Issue or pull request author
+	Author string
+}
+
+// Parts of the payloads of the issue_comment, issues and pull_request events (https://docs.github.com/en/webhooks/webhook-events-and-payloads)
+type eventPayload struct {
+	Action      string      `json:"action"`
+	Issue       *eventIssue `json:"issue"`
+	PullRequest *eventIssue `json:"pull_request"`
+	Comment     *struct {
+		ID                int64     `json:"id"`
+		Body              string    `json:"body"`
+		AuthorAssociation string    `json:"author_association"`
+		User              eventUser `json:"user"`
+	} `json:"comment"`
+	Repository *struct {
+		Name  string    `json:"name"`
+		Owner eventUser `json:"owner"`
+	} `json:"repository"`
+}
+
+type eventIssue struct {
+	Number            int       `json:"number"`
+	AuthorAssociation string    `json:"author_association"`
+	User              eventUser `json:"user"`
+	// Set when an issue_comment event is for a pull request
+	PullRequest *struct{} `json:"pull_request"`
+}
+
+type eventUser struct {
+	Login string `json:"login"`
+}
+
+// ReadActionsEvent reads the event that triggered the GitHub Actions workflow from GITHUB_EVENT_PATH,
+// with the event name from GITHUB_EVENT_NAME and the repository from GITHUB_REPOSITORY.
+func ReadActionsEvent() (*Event, error) {
+	path := os.Getenv("GITHUB_EVENT_PATH")
+	if path == "" {
+		return nil, fmt.Errorf("GITHUB_EVENT_PATH is not set")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading event payload: %w", err)
+	}
+	return ParseEvent(os.Getenv("GITHUB_EVENT_NAME"), data, os.Getenv("GITHUB_REPOSITORY"))
+}
+
+// ParseEvent parses an issue_comment, issues or pull_request event payload.
+// If name is empty, the event is detected from the payload. The owner and repo are taken from repository ("owner/repo"),
+// or from the payload if repository is empty.
+func ParseEvent(name string, data []byte, repository string) (*Event, error) {
+	var payload eventPayload
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return nil, fmt.Errorf("decoding event payload: %w", err)
+	}
+	if name == "" {
+		name = detectEventName(&payload)
+	}
+
+	event := &Event{Name: name, Action: payload.Action}
+	switch name {
+	case "issue_comment":
+		if payload.Issue == nil || payload.Comment == nil {
+			return nil, fmt.Errorf("issue_comment event without issue or comment")
+		}
+		event.Number = payload.Issue.Number
+		event.IsPullRequest = payload.Issue.PullRequest != nil
+		event.CommentID = payload.Comment.ID
+		event.CommentBody = payload.Comment.Body
+		event.AuthorAssociation = payload.Comment.AuthorAssociation
+		event.Author = payload.Comment.User.Login
+	case "issues":
+		if payload.Issue == nil {
+			return nil, fmt.Errorf("issues event without issue")
+		}
+		event.Number = payload.Issue.Number
+		event.AuthorAssociation = payload.Issue.AuthorAssociation
+		event.Author = payload.Issue.User.Login
+	case "pull_request", "pull_request_target":
+		if payload.PullRequest == nil {
+			return nil, fmt.Errorf("%s event without pull_request", name)
+		}
+		event.Number = payload.PullRequest.Number
+		event.IsPullRequest = true
+		event.AuthorAssociation = payload.PullRequest.AuthorAssociation
+		event.Author = payload.PullRequest.User.Login
+	default:
+		return nil, fmt.Errorf("unsupported event: %q", name)
+	}
+
+	if owner, repo, ok := strings.Cut(repository, "/"); ok && owner != "" && repo != "" {
+		event.Owner, event.Repo = owner, repo
+	} else if payload.Repository != nil && payload.Repository.Name != "" {
+		event.Owner, event.Repo = payload.Repository.Owner.Login, payload.Repository.Name
+	} else {
+		return nil, fmt.Errorf("invalid repository %q, expected owner/repo", repository)
+	}
+	return event, nil
+}
+
+// detectEventName guesses the event from the fields of the payload
+func detectEventName(payload *eventPayload) string {
+	switch {
+	case payload.Comment != nil && payload.Issue != nil:
+		return "issue_comment"
+	case payload.PullRequest != nil:
+		return "pull_request"
+	case payload.Issue != nil:
+		return "issues"
+	default:
+		return ""
+	}
+}
@@ -4,7 +4,10 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net/http"
+	"net/url"
 	"os"
+	"strings"
 
 	"github.com/google/go-github/github"
 	"golang.org/x/oauth2"
@@ -15,10 +18,12 @@ type GitHubIssue struct {
 	repo        string
 	issueNumber int
 	cache       *github.Issue
-	token       string
+	tokenSource oauth2.TokenSource
 	client      *github.Client
 	ctx         context.Context
 	logger      *log.Logger
+	// Login of the authenticated identity, looked up on first use
+	login string
 }
 
 func (gh *GitHubIssue) GetIssue() (*github.Issue, error) {
@@ -49,34 +54,264 @@ func (gh *GitHubIssue) GetTitle() (*string, error) {
 	return issue.Title, err
 }
 
+// Maximum page size of the GitHub API
+const commentsPerPage = 100
+
+// CommentOptions limits the comments returned by GetCommentsWithOptions.
+type CommentOptions struct {
+	// Maximum number of comments. 0 means all comments.
+	Limit int
+	// Return the newest Limit comments instead of the oldest ones
+	MostRecent bool
+}
+
+// GetComments returns all comments on the issue, oldest first.
 func (gh *GitHubIssue) GetComments() ([]*github.IssueComment, error) {
+	return gh.GetCommentsWithOptions(CommentOptions{})
+}
+
+// GetCommentsWithOptions returns the comments on the issue, oldest first, reading as many pages as needed.
+func (gh *GitHubIssue) GetCommentsWithOptions(opts CommentOptions) ([]*github.IssueComment, error) {
+	first, resp, err := gh.listComments(1)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Limit > 0 && opts.MostRecent && resp.LastPage > 1 {
+		return gh.getRecentComments(first, resp.LastPage, opts.Limit)
+	}
+
+	comments := first
+	for resp.NextPage != 0 && (opts.Limit <= 0 || len(comments) < opts.Limit) {
+		var page []*github.IssueComment
+		page, resp, err = gh.listComments(resp.NextPage)
+		if err != nil {
+			return nil, err
+		}
+		comments = append(comments, page...)
+	}
+
+	if opts.Limit > 0 && len(comments) > opts.Limit {
+		if opts.MostRecent {
+			return comments[len(comments)-opts.Limit:], nil
+		}
+		return comments[:opts.Limit], nil
+	}
+	return comments, nil
+}
+
+// getRecentComments reads the pages from the last one backwards until limit comments are collected.
+// first is the already fetched first page.
+func (gh *GitHubIssue) getRecentComments(first []*github.IssueComment, lastPage int, limit int) ([]*github.IssueComment, error) {
+	var comments []*github.IssueComment
+	for page := lastPage; page >= 1 && len(comments) < limit; page-- {
+		pageComments := first
+		if page > 1 {
+			var err error
+			pageComments, _, err = gh.listComments(page)
+			if err != nil {
+				return nil, err
+			}
+		}
+		comments = append(pageComments, comments...)
+	}
+
+	if len(comments) > limit {
+		comments = comments[len(comments)-limit:]
+	}
+	return comments, nil
+}
+
+func (gh *GitHubIssue) listComments(page int) ([]*github.IssueComment, *github.Response, error) {
 	// Options
 	opt := &github.IssueListCommentsOptions{Direction: "asc", Sort: "created"}
-	opt.Page = 1
-	opt.PerPage = 100
+	opt.Page = page
+	opt.PerPage = commentsPerPage
 
-	comments, _, err := gh.client.Issues.ListComments(gh.ctx, gh.owner, gh.repo, gh.issueNumber, opt)
-	return comments, err
+	comments, resp, err := gh.client.Issues.ListComments(gh.ctx, gh.owner, gh.repo, gh.issueNumber, opt)
+	if err != nil {
+		return nil, nil, fmt.Errorf("listing comments (page %d): %w", page, err)
+	}
+	return comments, resp, nil
 }
 
+// MaxCommentLength is the maximum number of characters in the body of a comment
+const MaxCommentLength = 65536
+
 func (gh *GitHubIssue) PostComment(commentBody string) error {
+	_, err := gh.CreateComment(commentBody)
+	return err
+}
+
+// CreateComment posts a comment on the Issue and returns it, e.g. to edit it later
+func (gh *GitHubIssue) CreateComment(commentBody string) (*github.IssueComment, error) {
 	comment := &github.IssueComment{Body: github.String(commentBody)}
-	_, _, err := gh.client.Issues.CreateComment(gh.ctx, gh.owner, gh.repo, gh.issueNumber, comment)
+	created, _, err := gh.client.Issues.CreateComment(gh.ctx, gh.owner, gh.repo, gh.issueNumber, comment)
 	if err != nil {
-		return fmt.Errorf("error creating comment: %w", err)
+		return nil, fmt.Errorf("error creating comment: %w", err)
 	}
 	gh.logger.Printf("Comment created successfully on Issue %d", gh.issueNumber)
+	return created, nil
+}
+
+// EditComment replaces the body of a comment on the Issue
+func (gh *GitHubIssue) EditComment(commentID int64, commentBody string) error {
+	comment := &github.IssueComment{Body: github.String(commentBody)}
+	_, _, err := gh.client.Issues.EditComment(gh.ctx, gh.owner, gh.repo, commentID, comment)
+	if err != nil {
+		return fmt.Errorf("error editing comment %d: %w", commentID, err)
+	}
+	gh.logger.Printf("Comment %d edited successfully on Issue %d", commentID, gh.issueNumber)
+	return nil
+}
+
+// DeleteComment deletes a comment on the Issue
+func (gh *GitHubIssue) DeleteComment(commentID int64) error {
+	if _, err := gh.client.Issues.DeleteComment(gh.ctx, gh.owner, gh.repo, commentID); err != nil {
+		return fmt.Errorf("error deleting comment %d: %w", commentID, err)
+	}
+	gh.logger.Printf("Comment %d deleted successfully on Issue %d", commentID, gh.issueNumber)
 	return nil
 }
 
+// FindComment returns the newest comment on the Issue that the authenticated identity posted and whose body starts with prefix,
+// or nil if there is none. Comments by others are never returned, even if they copy the prefix.
+func (gh *GitHubIssue) FindComment(prefix string) (*github.IssueComment, error) {
+	login, err := gh.Login()
+	if err != nil {
+		return nil, err
+	}
+	comments, err := gh.GetComments()
+	if err != nil {
+		return nil, err
+	}
+	for i := len(comments) - 1; i >= 0; i-- {
+		if comments[i].GetUser().GetLogin() == login && strings.HasPrefix(comments[i].GetBody(), prefix) {
+			return comments[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// ActionsLogin is the user that posts the comments of the GITHUB_TOKEN of GitHub Actions
+const ActionsLogin = "github-actions[bot]"
+
+// Login returns the login of the authenticated identity, which posts the comments.
+// It is looked up with GET /user on first use, unless it is set with SetLogin.
+func (gh *GitHubIssue) Login() (string, error) {
+	if gh.login == "" {
+		user, resp, err := gh.client.Users.Get(gh.ctx, "")
+		if err != nil {
+			// Installation tokens, like the GITHUB_TOKEN of GitHub Actions, cannot read GET /user
+			if resp != nil && resp.StatusCode == http.StatusForbidden {
+				gh.logger.Printf("The GitHub token cannot look up its user, assuming %s", ActionsLogin)
+				gh.login = ActionsLogin
+				return gh.login, nil
+			}
+			return "", fmt.Errorf("error getting the authenticated user: %w", err)
+		}
+		gh.login = user.GetLogin()
+	}
+	return gh.login, nil
+}
+
+// SetLogin sets the login of the authenticated identity, e.g. the bot user of a GitHub App (see App.Login),
+// whose installation tokens cannot read GET /user
+func (gh *GitHubIssue) SetLogin(login string) {
+	gh.login = login
+}
+
+// Reactions (https://docs.github.com/en/rest/reactions/reactions#about-reactions)
+const (
+	ReactionEyes     = "eyes"
+	ReactionRocket   = "rocket"
+	ReactionConfused = "confused"
+)
+
+// AddReaction adds a reaction, e.g. ReactionEyes, to a comment on the Issue, or to the Issue itself if commentID is 0
+func (gh *GitHubIssue) AddReaction(commentID int64, content string) error {
+	// The version of go-github in use predates the endpoints to create reactions
+	path := fmt.Sprintf("repos/%s/%s/issues/%d/reactions", gh.owner, gh.repo, gh.issueNumber)
+	if commentID != 0 {
+		path = fmt.Sprintf("repos/%s/%s/issues/comments/%d/reactions", gh.owner, gh.repo, commentID)
+	}
+	req, err := gh.client.NewRequest("POST", path, map[string]string{"content": content})
+	if err != nil {
+		return fmt.Errorf("creating reaction request: %w", err)
+	}
+	if _, err := gh.client.Do(gh.ctx, req, nil); err != nil {
+		return fmt.Errorf("error adding %s reaction: %w", content, err)
+	}
+	return nil
+}
+
+// GetFile returns the content of a file in the repository at ref, or on the default branch if ref is empty
+func (gh *GitHubIssue) GetFile(path string, ref string) ([]byte, error) {
+	file, _, _, err := gh.client.Repositories.GetContents(gh.ctx, gh.owner, gh.repo, path, &github.RepositoryContentGetOptions{Ref: ref})
+	if err != nil {
+		return nil, fmt.Errorf("error getting %s from %s/%s: %w", path, gh.owner, gh.repo, err)
+	}
+	if file == nil {
+		return nil, fmt.Errorf("%s in %s/%s is not a file", path, gh.owner, gh.repo)
+	}
+	content, err := file.GetContent()
+	if err != nil {
+		return nil, fmt.Errorf("error decoding %s from %s/%s: %w", path, gh.owner, gh.repo, err)
+	}
+	return []byte(content), nil
+}
+
+// Repository returns the repository of the Issue as "owner/repo"
+func (gh *GitHubIssue) Repository() string {
+	return gh.owner + "/" + gh.repo
+}
+
+// EnterpriseHost returns the host name of the GitHub Enterprise Server, or "" on github.com
+func (gh *GitHubIssue) EnterpriseHost() string {
+	if host := gh.client.BaseURL.Hostname(); host != "api.github.com" {
+		return host
+	}
+	return ""
+}
+
+// Token returns the token used for the GitHub API, e.g. to download images attached to the Issue
+func (gh *GitHubIssue) Token() (string, error) {
+	token, err := gh.tokenSource.Token()
+	if err != nil {
+		return "", fmt.Errorf("getting GitHub token: %w", err)
+	}
+	return token.AccessToken, nil
+}
+
 func NewIssue(owner string, repo string, issueNumber int, token string) *GitHubIssue {
-	// Create GitHub client with OAuth2 token
-	ctx := context.Background()
 	ts := oauth2.StaticTokenSource(
 		&oauth2.Token{AccessToken: token},
 	)
+	return NewIssueWithTokenSource(owner, repo, issueNumber, ts)
+}
+
+// NewIssueWithTokenSource creates a GitHubIssue that authenticates with tokens from ts, e.g. the installation tokens of a GitHub App
+func NewIssueWithTokenSource(owner string, repo string, issueNumber int, ts oauth2.TokenSource) *GitHubIssue {
+	// The default endpoints are always valid
+	issue, _ := NewEnterpriseIssue(owner, repo, issueNumber, ts, "", "")
+	return issue
+}
+
+// NewEnterpriseIssue creates a GitHubIssue on a GitHub Enterprise Server. See EnterpriseURLs for baseURL and uploadURL.
+// If baseURL is empty, github.com is used.
+func NewEnterpriseIssue(owner string, repo string, issueNumber int, ts oauth2.TokenSource, baseURL, uploadURL string) (*GitHubIssue, error) {
+	// Create GitHub client with OAuth2 token
+	ctx := context.Background()
 	tc := oauth2.NewClient(ctx, ts)
 	client := github.NewClient(tc)
+	if baseURL != "" {
+		var err error
+		if baseURL, uploadURL, err = EnterpriseURLs(baseURL, uploadURL); err != nil {
+			return nil, err
+		}
+		if client, err = github.NewEnterpriseClient(baseURL, uploadURL, tc); err != nil {
+			return nil, fmt.Errorf("creating GitHub Enterprise client: %w", err)
+		}
+	}
 
 	// Initialize a logger
 	logger := log.New(
@@ -85,6 +320,35 @@ func NewIssue(owner string, repo string, issueNumber int, token string) *GitHubI
 	)
 
 	// Create a new GitHubIssue instance
-	issue := &GitHubIssue{owner: owner, repo: repo, issueNumber: issueNumber, token: token, client: client, ctx: ctx, logger: logger}
-	return issue
+	issue := &GitHubIssue{owner: owner, repo: repo, issueNumber: issueNumber, tokenSource: ts, client: client, ctx: ctx, logger: logger}
+	return issue, nil
+}
+
+// EnterpriseURLs completes the API endpoints of a GitHub Enterprise Server. A baseURL without a path,
+// e.g. "https://ghes.example.com", gets "/api/v3/", and an empty uploadURL defaults to "/api/uploads/" on the same host.
+func EnterpriseURLs(baseURL, uploadURL string) (string, string, error) {
+	base, err := url.Parse(baseURL)
+	if err != nil || base.Scheme == "" || base.Host == "" {
+		return "", "", fmt.Errorf("invalid GitHub base URL %q", baseURL)
+	}
+	if base.Path == "" || base.Path == "/" {
+		base.Path = "/api/v3/"
+	}
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+	}
+
+	if uploadURL == "" {
+		upload := *base
+		upload.Path = "/api/uploads/"
+		return base.String(), upload.String(), nil
+	}
+	upload, err := url.Parse(uploadURL)
+	if err != nil || upload.Scheme == "" || upload.Host == "" {
+		return "", "", fmt.Errorf("invalid GitHub upload URL %q", uploadURL)
+	}
+	if !strings.HasSuffix(upload.Path, "/") {
+		upload.Path += "/"
+	}
+	return base.String(), upload.String(), nil
 }
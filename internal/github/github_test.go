@@ -0,0 +1,571 @@
+package github
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/github"
+	"golang.org/x/oauth2"
+)
+
+// newTestIssue returns a GitHubIssue that sends requests to the given local server
+func newTestIssue(t *testing.T, serverURL string) *GitHubIssue {
+	t.Helper()
+	issue := NewIssue("owner", "repo", 1, "token")
+	baseURL, err := url.Parse(serverURL + "/")
+	if err != nil {
+		t.Fatalf("Error parsing server URL: %v", err)
+	}
+	issue.client.BaseURL = baseURL
+	return issue
+}
+
+// newCommentsServer returns a GitHub stand-in that serves numComments comments on issue #1 with Link headers,
+// and a pointer to the list of requested pages
+func newCommentsServer(t *testing.T, numComments int) (*httptest.Server, *[]int) {
+	t.Helper()
+	var requested []int
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repos/owner/repo/issues/1/comments" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		perPage, _ := strconv.Atoi(r.URL.Query().Get("per_page"))
+		requested = append(requested, page)
+
+		lastPage := max((numComments+perPage-1)/perPage, 1)
+		link := func(p int, rel string) string {
+			return fmt.Sprintf(`<%s%s?page=%d&per_page=%d>; rel="%s"`, server.URL, r.URL.Path, p, perPage, rel)
+		}
+		if page < lastPage {
+			w.Header().Add("Link", link(page+1, "next")+", "+link(lastPage, "last"))
+		}
+
+		comments := []*github.IssueComment{}
+		for id := (page-1)*perPage + 1; id <= min(page*perPage, numComments); id++ {
+			comments = append(comments, &github.IssueComment{ID: github.Int64(int64(id)), Body: github.String(fmt.Sprintf("comment %d", id))})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(comments)
+	}))
+	t.Cleanup(server.Close)
+	return server, &requested
+}
+
+// TestGetCommentsWithOptions tests pagination against a GitHub stand-in
+func TestGetCommentsWithOptions(t *testing.T) {
+	tests := []struct {
+		name          string
+		numComments   int
+		opts          CommentOptions
+		expectedFirst int64
+		expectedLast  int64
+		expectedCount int
+		expectedPages []int
+	}{
+		{"All comments on a single page", 3, CommentOptions{}, 1, 3, 3, []int{1}},
+		{"All comments on multiple pages", 250, CommentOptions{}, 1, 250, 250, []int{1, 2, 3}},
+		{"Oldest comments up to the limit", 250, CommentOptions{Limit: 150}, 1, 150, 150, []int{1, 2}},
+		{"Most recent comments", 250, CommentOptions{Limit: 120, MostRecent: true}, 131, 250, 120, []int{1, 3, 2}},
+		{"Most recent comments on the last page", 250, CommentOptions{Limit: 10, MostRecent: true}, 241, 250, 10, []int{1, 3}},
+		{"Most recent comments on a single page", 3, CommentOptions{Limit: 2, MostRecent: true}, 2, 3, 2, []int{1}},
+		{"Limit above the number of comments", 250, CommentOptions{Limit: 1000, MostRecent: true}, 1, 250, 250, []int{1, 3, 2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, requested := newCommentsServer(t, tt.numComments)
+			comments, err := newTestIssue(t, server.URL).GetCommentsWithOptions(tt.opts)
+			if err != nil {
+				t.Fatalf("GetCommentsWithOptions returned an error: %v", err)
+			}
+			if len(comments) != tt.expectedCount {
+				t.Fatalf("expected %d comments, got %d", tt.expectedCount, len(comments))
+			}
+			if comments[0].GetID() != tt.expectedFirst || comments[len(comments)-1].GetID() != tt.expectedLast {
+				t.Errorf("expected comments %d to %d, got %d to %d", tt.expectedFirst, tt.expectedLast, comments[0].GetID(), comments[len(comments)-1].GetID())
+			}
+			for i := 1; i < len(comments); i++ {
+				if comments[i].GetID() != comments[i-1].GetID()+1 {
+					t.Fatalf("expected comments in ascending order, got %d after %d", comments[i].GetID(), comments[i-1].GetID())
+				}
+			}
+			if fmt.Sprint(*requested) != fmt.Sprint(tt.expectedPages) {
+				t.Errorf("expected pages %v to be requested, got %v", tt.expectedPages, *requested)
+			}
+		})
+	}
+}
+
+// TestGetCommentsError tests that API errors are returned
+func TestGetCommentsError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	if _, err := newTestIssue(t, server.URL).GetComments(); err == nil {
+		t.Error("expected an error, got nil")
+	}
+}
+
+// TestParseEvent tests that the repository, number and comment are read from each event payload
+func TestParseEvent(t *testing.T) {
+	const issueComment = `{"action":"created","issue":{"number":12,"user":{"login":"alice"},"author_association":"NONE"},` +
+		`"comment":{"id":34,"body":"/ask Why?\nIt's \"down\"","author_association":"MEMBER","user":{"login":"bob"}},` +
+		`"repository":{"name":"repo","owner":{"login":"owner"}}}`
+	const prComment = `{"issue":{"number":7,"pull_request":{"url":"https://api.github.com/repos/owner/repo/pulls/7"}},` +
+		`"comment":{"body":"/describe","author_association":"OWNER","user":{"login":"carol"}}}`
+	const issues = `{"action":"opened","issue":{"number":3,"user":{"login":"alice"},"author_association":"COLLABORATOR"}}`
+	const pullRequest = `{"action":"opened","pull_request":{"number":9,"user":{"login":"dave"},"author_association":"MEMBER"}}`
+
+	tests := []struct {
+		name       string
+		eventName  string
+		payload    string
+		repository string
+		expected   Event
+		expectErr  bool
+	}{
+		{"issue_comment", "issue_comment", issueComment, "owner/repo",
+			Event{Name: "issue_comment", Action: "created", Owner: "owner", Repo: "repo", Number: 12, CommentID: 34, CommentBody: "/ask Why?\nIt's \"down\"", AuthorAssociation: "MEMBER", Author: "bob"}, false},
+		{"Repository from the payload", "issue_comment", issueComment, "",
+			Event{Name: "issue_comment", Action: "created", Owner: "owner", Repo: "repo", Number: 12, CommentID: 34, CommentBody: "/ask Why?\nIt's \"down\"", AuthorAssociation: "MEMBER", Author: "bob"}, false},
+		{"Comment on a pull request", "", prComment, "owner/repo",
+			Event{Name: "issue_comment", Owner: "owner", Repo: "repo", Number: 7, IsPullRequest: true, CommentBody: "/describe", AuthorAssociation: "OWNER", Author: "carol"}, false},
+		{"issues", "issues", issues, "owner/repo",
+			Event{Name: "issues", Action: "opened", Owner: "owner", Repo: "repo", Number: 3, AuthorAssociation: "COLLABORATOR", Author: "alice"}, false},
+		{"pull_request", "", pullRequest, "owner/repo",
+			Event{Name: "pull_request", Action: "opened", Owner: "owner", Repo: "repo", Number: 9, IsPullRequest: true, AuthorAssociation: "MEMBER", Author: "dave"}, false},
+		{"No repository", "issues", issues, "", Event{}, true},
+		{"Unsupported event", "push", `{"ref":"refs/heads/main"}`, "owner/repo", Event{}, true},
+		{"Missing comment", "issue_comment", issues, "owner/repo", Event{}, true},
+		{"Invalid JSON", "issues", "{", "owner/repo", Event{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event, err := ParseEvent(tt.eventName, []byte(tt.payload), tt.repository)
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("expected error: %v, got %v", tt.expectErr, err)
+			}
+			if err == nil && *event != tt.expected {
+				t.Errorf("expected %+v, got %+v", tt.expected, *event)
+			}
+		})
+	}
+}
+
+// TestReadActionsEvent tests that the payload is read from GITHUB_EVENT_PATH
+func TestReadActionsEvent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "event.json")
+	if err := os.WriteFile(path, []byte(`{"issue":{"number":5},"comment":{"body":"/describe"}}`), 0o600); err != nil {
+		t.Fatalf("Error writing event payload: %v", err)
+	}
+	t.Setenv("GITHUB_EVENT_PATH", path)
+	t.Setenv("GITHUB_EVENT_NAME", "issue_comment")
+	t.Setenv("GITHUB_REPOSITORY", "owner/repo")
+
+	event, err := ReadActionsEvent()
+	if err != nil {
+		t.Fatalf("ReadActionsEvent returned an error: %v", err)
+	}
+	if event.Owner != "owner" || event.Repo != "repo" || event.Number != 5 || event.CommentBody != "/describe" {
+		t.Errorf("unexpected event %+v", event)
+	}
+
+	t.Setenv("GITHUB_EVENT_PATH", "")
+	if _, err := ReadActionsEvent(); err == nil {
+		t.Error("expected an error without GITHUB_EVENT_PATH")
+	}
+}
+
+// newTestAppKey returns a new RSA key and its PKCS#1 PEM encoding
+func newTestAppKey(t *testing.T) (*rsa.PrivateKey, []byte) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	return key, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+}
+
+// verifyTestJWT checks that the Authorization header is a JWT for app 123 signed with key
+func verifyTestJWT(t *testing.T, key *rsa.PrivateKey, authorization string) {
+	t.Helper()
+	jwt, ok := strings.CutPrefix(authorization, "Bearer ")
+	parts := strings.Split(jwt, ".")
+	if !ok || len(parts) != 3 {
+		t.Errorf("expected a bearer JWT, got %q", authorization)
+		return
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		t.Errorf("Error decoding JWT signature: %v", err)
+		return
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature); err != nil {
+		t.Errorf("invalid JWT signature: %v", err)
+	}
+	claims, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	if !strings.Contains(string(claims), `"iss":"123"`) {
+		t.Errorf("expected issuer 123, got %s", claims)
+	}
+}
+
+// TestAppTokenSource tests that the installation is looked up, and that installation tokens are reused until they expire
+func TestAppTokenSource(t *testing.T) {
+	key, keyPEM := newTestAppKey(t)
+	var tokenRequests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		verifyTestJWT(t, key, r.Header.Get("Authorization"))
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/repos/owner/repo/installation":
+			_, _ = w.Write([]byte(`{"id":42}`))
+		case r.Method == http.MethodGet && r.URL.Path == "/app":
+			_, _ = w.Write([]byte(`{"slug":"alert-menta"}`))
+		case r.Method == http.MethodPost && r.URL.Path == "/app/installations/42/access_tokens":
+			tokenRequests++
+			expiresAt := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+			_, _ = fmt.Fprintf(w, `{"token":"ghs_%d","expires_at":"%s"}`, tokenRequests, expiresAt)
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	app, err := NewApp(123, keyPEM, 0, "")
+	if err != nil {
+		t.Fatalf("NewApp returned an error: %v", err)
+	}
+	app.baseURL = server.URL
+
+	issue := NewIssueWithTokenSource("owner", "repo", 1, app.TokenSource("owner", "repo"))
+	for i := 0; i < 2; i++ {
+		token, err := issue.Token()
+		if err != nil {
+			t.Fatalf("Token returned an error: %v", err)
+		}
+		if token != "ghs_1" {
+			t.Errorf("expected token ghs_1, got %q", token)
+		}
+	}
+	if tokenRequests != 1 {
+		t.Errorf("expected 1 token request, got %d", tokenRequests)
+	}
+	if app.TokenSource("owner", "repo") != app.TokenSource("owner", "repo") {
+		t.Error("expected the token source of a repository to be reused")
+	}
+	if login, err := app.Login(context.Background()); err != nil || login != "alert-menta[bot]" {
+		t.Errorf("expected login alert-menta[bot], got %q and %v", login, err)
+	}
+}
+
+// TestNewApp tests that invalid app settings are rejected
+func TestNewApp(t *testing.T) {
+	_, keyPEM := newTestAppKey(t)
+	tests := []struct {
+		name      string
+		appID     int64
+		key       []byte
+		expectErr bool
+	}{
+		{"Valid", 123, keyPEM, false},
+		{"Missing app ID", 0, keyPEM, true},
+		{"Not PEM", 123, []byte("not a key"), true},
+		{"Invalid key", 123, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: []byte("invalid")}), true},
+	}
+
+	for _, tt := range tests {
+		if _, err := NewApp(tt.appID, tt.key, 0, ""); (err != nil) != tt.expectErr {
+			t.Errorf("%s: expected error: %v, got %v", tt.name, tt.expectErr, err)
+		}
+	}
+}
+
+// TestEnterpriseURLs tests that the endpoints of a GitHub Enterprise Server are completed
+func TestEnterpriseURLs(t *testing.T) {
+	tests := []struct {
+		name           string
+		baseURL        string
+		uploadURL      string
+		expectedBase   string
+		expectedUpload string
+		expectErr      bool
+	}{
+		{"Host only", "https://ghes.example.com", "", "https://ghes.example.com/api/v3/", "https://ghes.example.com/api/uploads/", false},
+		{"API path", "https://ghes.example.com/api/v3", "", "https://ghes.example.com/api/v3/", "https://ghes.example.com/api/uploads/", false},
+		{"Upload URL", "https://ghes.example.com/api/v3/", "https://uploads.example.com", "https://ghes.example.com/api/v3/", "https://uploads.example.com/", false},
+		{"No scheme", "ghes.example.com", "", "", "", true},
+		{"Invalid upload URL", "https://ghes.example.com", "/api/uploads", "", "", true},
+	}
+
+	for _, tt := range tests {
+		base, upload, err := EnterpriseURLs(tt.baseURL, tt.uploadURL)
+		if (err != nil) != tt.expectErr {
+			t.Errorf("%s: expected error: %v, got %v", tt.name, tt.expectErr, err)
+			continue
+		}
+		if base != tt.expectedBase || upload != tt.expectedUpload {
+			t.Errorf("%s: expected %q and %q, got %q and %q", tt.name, tt.expectedBase, tt.expectedUpload, base, upload)
+		}
+	}
+}
+
+// TestNewEnterpriseIssue tests that requests go to the API of the GitHub Enterprise Server
+func TestNewEnterpriseIssue(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v3/repos/owner/repo/issues/1" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer token" {
+			t.Errorf("unexpected Authorization header %q", got)
+		}
+		_, _ = w.Write([]byte(`{"number":1,"title":"Title"}`))
+	}))
+	defer server.Close()
+
+	issue, err := NewEnterpriseIssue("owner", "repo", 1, oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "token"}), server.URL, "")
+	if err != nil {
+		t.Fatalf("NewEnterpriseIssue returned an error: %v", err)
+	}
+	title, err := issue.GetTitle()
+	if err != nil {
+		t.Fatalf("GetTitle returned an error: %v", err)
+	}
+	if *title != "Title" {
+		t.Errorf("expected title %q, got %q", "Title", *title)
+	}
+	if host := issue.EnterpriseHost(); host != "127.0.0.1" {
+		t.Errorf("expected enterprise host 127.0.0.1, got %q", host)
+	}
+	if host := NewIssue("owner", "repo", 1, "token").EnterpriseHost(); host != "" {
+		t.Errorf("expected no enterprise host on github.com, got %q", host)
+	}
+}
+
+// TestGetPullRequest tests that the files, commits, review comments and diff of a pull request are read
+func TestGetPullRequest(t *testing.T) {
+	diff := "diff --git a/a.go b/a.go\n+a\ndiff --git a/b.go b/b.go\n+b\n"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/repos/owner/repo/pulls/1/files":
+			_, _ = w.Write([]byte(`[{"filename":"a.go","status":"modified","additions":1},{"filename":"b.go","status":"added","additions":1}]`))
+		case "/repos/owner/repo/pulls/1/commits":
+			_, _ = w.Write([]byte(`[{"sha":"0123456789","commit":{"message":"Fix a"}}]`))
+		case "/repos/owner/repo/pulls/1/comments":
+			_, _ = w.Write([]byte(`[{"body":"Why?","path":"a.go","user":{"login":"bob"}}]`))
+		case "/repos/owner/repo/pulls/1":
+			if accept := r.Header.Get("Accept"); !strings.Contains(accept, "diff") {
+				t.Errorf("expected a diff to be requested, got Accept %q", accept)
+			}
+			_, _ = w.Write([]byte(diff))
+		default:
+			t.Errorf("unexpected path %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	issue := newTestIssue(t, server.URL)
+	pr, err := issue.GetPullRequest(40)
+	if err != nil {
+		t.Fatalf("GetPullRequest returned an error: %v", err)
+	}
+	if len(pr.Files) != 2 || len(pr.Commits) != 1 || len(pr.ReviewComments) != 1 {
+		t.Errorf("expected 2 files, 1 commit and 1 review comment, got %d, %d and %d", len(pr.Files), len(pr.Commits), len(pr.ReviewComments))
+	}
+	if expected := "diff --git a/a.go b/a.go\n+a\n"; pr.Diff != expected || pr.DiffBytes != len(diff) {
+		t.Errorf("expected diff %q of %d bytes, got %q of %d bytes", expected, len(diff), pr.Diff, pr.DiffBytes)
+	}
+
+	// The diff is not requested when it is left out
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/repos/owner/repo/pulls/1" {
+			t.Error("expected the diff not to be requested")
+		}
+		_, _ = w.Write([]byte(`[]`))
+	})
+	if pr, err = issue.GetPullRequest(0); err != nil || pr.Diff != "" {
+		t.Errorf("expected no diff and no error, got %q and %v", pr.Diff, err)
+	}
+}
+
+// TestTruncateDiff tests that diffs are cut between files, or between lines when the first file is too large
+func TestTruncateDiff(t *testing.T) {
+	diff := "diff --git a/a.go b/a.go\n+a\ndiff --git a/b.go b/b.go\n+b\n"
+	tests := []struct {
+		name     string
+		maxBytes int
+		expected string
+	}{
+		{"Fits", len(diff), diff},
+		{"Between files", len(diff) - 1, "diff --git a/a.go b/a.go\n+a\n"},
+		{"Between lines", 27, "diff --git a/a.go b/a.go\n"},
+		{"No line", 5, ""},
+	}
+
+	for _, tt := range tests {
+		if got := TruncateDiff(diff, tt.maxBytes); got != tt.expected {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.expected, got)
+		}
+	}
+}
+
+// TestFindAndEditComment tests that the newest comment with the prefix is found and edited
+func TestFindAndEditComment(t *testing.T) {
+	var edited string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/user":
+			_, _ = w.Write([]byte(`{"login":"bot"}`))
+		case r.Method == http.MethodGet && r.URL.Path == "/repos/owner/repo/issues/1/comments":
+			// Comment 4 copies the marker, but it is not by the authenticated user
+			_, _ = w.Write([]byte(`[{"id":1,"body":"<!-- marker -->old","user":{"login":"bot"}},{"id":2,"body":"<!-- marker -->new","user":{"login":"bot"}},` +
+				`{"id":3,"body":"other","user":{"login":"bot"}},{"id":4,"body":"<!-- marker -->fake","user":{"login":"mallory"}}]`))
+		case r.Method == http.MethodPatch && r.URL.Path == "/repos/owner/repo/issues/comments/2":
+			var comment github.IssueComment
+			if err := json.NewDecoder(r.Body).Decode(&comment); err != nil {
+				t.Errorf("decoding request: %v", err)
+			}
+			edited = comment.GetBody()
+			_, _ = w.Write([]byte(`{"id":2}`))
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	issue := newTestIssue(t, server.URL)
+	comment, err := issue.FindComment("<!-- marker -->")
+	if err != nil {
+		t.Fatalf("FindComment returned an error: %v", err)
+	}
+	if comment.GetID() != 2 {
+		t.Fatalf("expected comment 2, got %d", comment.GetID())
+	}
+	if err := issue.EditComment(comment.GetID(), "edited"); err != nil {
+		t.Fatalf("EditComment returned an error: %v", err)
+	}
+	if edited != "edited" {
+		t.Errorf("expected body %q, got %q", "edited", edited)
+	}
+
+	if comment, err = issue.FindComment("<!-- missing -->"); err != nil || comment != nil {
+		t.Errorf("expected no comment and no error, got %v and %v", comment, err)
+	}
+}
+
+// TestLogin tests that the user of the token is looked up once, and that installation tokens are assumed to be GitHub Actions
+func TestLogin(t *testing.T) {
+	status, requests := http.StatusOK, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(`{"login":"bot","message":"Resource not accessible by integration"}`))
+	}))
+	defer server.Close()
+
+	issue := newTestIssue(t, server.URL)
+	for i := 0; i < 2; i++ {
+		if login, err := issue.Login(); err != nil || login != "bot" {
+			t.Errorf("expected login bot, got %q and %v", login, err)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("expected 1 request, got %d", requests)
+	}
+
+	status = http.StatusForbidden
+	if login, err := newTestIssue(t, server.URL).Login(); err != nil || login != ActionsLogin {
+		t.Errorf("expected login %s, got %q and %v", ActionsLogin, login, err)
+	}
+	status = http.StatusUnauthorized
+	if _, err := newTestIssue(t, server.URL).Login(); err == nil {
+		t.Error("expected an error for an invalid token")
+	}
+	issue = newTestIssue(t, server.URL)
+	issue.SetLogin("app[bot]")
+	if login, _ := issue.Login(); login != "app[bot]" {
+		t.Errorf("expected the login set with SetLogin, got %q", login)
+	}
+}
+
+// TestAddReaction tests that reactions go to the comment, or to the Issue without a comment ID
+func TestAddReaction(t *testing.T) {
+	var requested []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reaction struct {
+			Content string `json:"content"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&reaction); err != nil {
+			t.Errorf("decoding request: %v", err)
+		}
+		requested = append(requested, r.Method+" "+r.URL.Path+" "+reaction.Content)
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"id":1}`))
+	}))
+	defer server.Close()
+
+	issue := newTestIssue(t, server.URL)
+	if err := issue.AddReaction(34, ReactionEyes); err != nil {
+		t.Fatalf("AddReaction returned an error: %v", err)
+	}
+	if err := issue.AddReaction(0, ReactionRocket); err != nil {
+		t.Fatalf("AddReaction returned an error: %v", err)
+	}
+	expected := []string{"POST /repos/owner/repo/issues/comments/34/reactions eyes", "POST /repos/owner/repo/issues/1/reactions rocket"}
+	if strings.Join(requested, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected requests %q, got %q", expected, requested)
+	}
+}
+
+// Test for GetFile
+func TestGetFile(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repos/owner/repo/contents/config/alert-menta.yaml" || r.URL.Query().Get("ref") != "main" {
+			http.NotFound(w, r)
+			return
+		}
+		content := base64.StdEncoding.EncodeToString([]byte("ai:\n  provider: anthropic\n"))
+		_, _ = fmt.Fprintf(w, `{"type":"file","encoding":"base64","content":%q}`, content)
+	}))
+	defer server.Close()
+
+	issue := newTestIssue(t, server.URL)
+	got, err := issue.GetFile("config/alert-menta.yaml", "main")
+	if err != nil {
+		t.Fatalf("GetFile returned an error: %v", err)
+	}
+	if string(got) != "ai:\n  provider: anthropic\n" {
+		t.Errorf("unexpected content %q", got)
+	}
+	if _, err := issue.GetFile("missing.yaml", ""); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
@@ -0,0 +1,98 @@
+package github
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/go-github/github"
+)
+
+// PullRequest holds what is read from a pull request in addition to its Issue
+type PullRequest struct {
+	Files          []*github.CommitFile
+	Commits        []*github.RepositoryCommit
+	ReviewComments []*github.PullRequestComment
+	// Unified diff, cut to the requested size. Empty if it was not requested or GitHub could not produce it.
+	Diff string
+	// Size of the whole diff in bytes
+	DiffBytes int
+}
+
+// IsPullRequest reports whether the Issue is a pull request
+func (gh *GitHubIssue) IsPullRequest() (bool, error) {
+	issue, err := gh.GetIssue()
+	if err != nil {
+		return false, err
+	}
+	return issue.IsPullRequest(), nil
+}
+
+// GetPullRequest returns the changed files, commits and review comments of the pull request, and at most maxDiffBytes of its diff.
+// The diff is left out if maxDiffBytes is 0 or less.
+func (gh *GitHubIssue) GetPullRequest(maxDiffBytes int) (*PullRequest, error) {
+	files, err := listAll(func(opt *github.ListOptions) ([]*github.CommitFile, *github.Response, error) {
+		return gh.client.PullRequests.ListFiles(gh.ctx, gh.owner, gh.repo, gh.issueNumber, opt)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing files: %w", err)
+	}
+	commits, err := listAll(func(opt *github.ListOptions) ([]*github.RepositoryCommit, *github.Response, error) {
+		return gh.client.PullRequests.ListCommits(gh.ctx, gh.owner, gh.repo, gh.issueNumber, opt)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing commits: %w", err)
+	}
+	reviewComments, err := listAll(func(opt *github.ListOptions) ([]*github.PullRequestComment, *github.Response, error) {
+		return gh.client.PullRequests.ListComments(gh.ctx, gh.owner, gh.repo, gh.issueNumber,
+			&github.PullRequestListCommentsOptions{Sort: "created", Direction: "asc", ListOptions: *opt})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing review comments: %w", err)
+	}
+
+	pr := &PullRequest{Files: files, Commits: commits, ReviewComments: reviewComments}
+	if maxDiffBytes > 0 {
+		diff, _, err := gh.client.PullRequests.GetRaw(gh.ctx, gh.owner, gh.repo, gh.issueNumber, github.RawOptions{Type: github.Diff})
+		if err != nil {
+			// GitHub refuses diffs that are too large, the file list is still useful
+			gh.logger.Printf("Skipped the diff of pull request %d: %v", gh.issueNumber, err)
+		} else {
+			pr.DiffBytes = len(diff)
+			pr.Diff = TruncateDiff(diff, maxDiffBytes)
+		}
+	}
+	return pr, nil
+}
+
+// listAll reads every page of a list endpoint
+func listAll[T any](list func(opt *github.ListOptions) ([]T, *github.Response, error)) ([]T, error) {
+	opt := &github.ListOptions{PerPage: commentsPerPage}
+	var all []T
+	for {
+		items, resp, err := list(opt)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, items...)
+		if resp.NextPage == 0 {
+			return all, nil
+		}
+		opt.Page = resp.NextPage
+	}
+}
+
+// TruncateDiff cuts a unified diff to at most maxBytes. It cuts before the first file that does not fit,
+// or at the end of a line when the first file alone is too large.
+func TruncateDiff(diff string, maxBytes int) string {
+	if len(diff) <= maxBytes {
+		return diff
+	}
+	cut := diff[:maxBytes]
+	if i := strings.LastIndex(cut, "\ndiff --git "); i > 0 {
+		return cut[:i+1]
+	}
+	if i := strings.LastIndex(cut, "\n"); i >= 0 {
+		return cut[:i+1]
+	}
+	return ""
+}
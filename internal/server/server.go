@@ -0,0 +1,319 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/3-shake/alert-menta/internal/github"
+)
+
+// Defaults of Options
+const (
+	DefaultWorkers      = 4
+	DefaultQueueSize    = 100
+	DefaultDeliveryIDs  = 1000
+	DefaultMaxBodyBytes = 25 << 20 // the maximum payload size of GitHub webhooks
+)
+
+// Handler runs a command for a webhook event. ctx is canceled when the server shuts down before the handler returns.
+type Handler func(ctx context.Context, event *github.Event) error
+
+// Options configures a Server. Unset fields use the defaults.
+type Options struct {
+	// Secret of the webhook, used to verify X-Hub-Signature-256
+	Secret []byte
+	// Number of events handled at the same time
+	Workers int
+	// Number of events waiting for a worker. Events over the limit are refused with 503 so that GitHub reports the failure.
+	QueueSize int
+	// Number of recent delivery IDs remembered to ignore redeliveries of the same event
+	DeliveryIDs  int
+	MaxBodyBytes int64
+}
+
+// Server receives GitHub issue_comment webhooks and hands them to a Handler on a bounded pool of workers
+type Server struct {
+	opts       Options
+	handle     Handler
+	queue      chan job
+	deliveries *deliveryCache
+	// Set while the server accepts webhooks, reported by /readyz
+	ready atomic.Bool
+	// Guards queue against sends after it is closed
+	mu      sync.RWMutex
+	closed  bool
+	workers sync.WaitGroup
+	// Canceled when the workers have to stop before they are done
+	ctx    context.Context
+	cancel context.CancelFunc
+	logger *log.Logger
+}
+
+type job struct {
+	deliveryID string
+	event      *github.Event
+}
+
+// New creates a Server that passes issue_comment events to handle. Start must be called before events are handled.
+func New(opts Options, handle Handler) (*Server, error) {
+	if len(opts.Secret) == 0 {
+		return nil, fmt.Errorf("webhook secret is required")
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = DefaultWorkers
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = DefaultQueueSize
+	}
+	if opts.DeliveryIDs <= 0 {
+		opts.DeliveryIDs = DefaultDeliveryIDs
+	}
+	if opts.MaxBodyBytes <= 0 {
+		opts.MaxBodyBytes = DefaultMaxBodyBytes
+	}
+
+	// Initialize a logger
+	logger := log.New(
+		os.Stdout, "[alert-menta server] ",
+		log.Ldate|log.Ltime|log.Llongfile|log.Lmsgprefix,
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Server{
+		opts:       opts,
+		handle:     handle,
+		queue:      make(chan job, opts.QueueSize),
+		deliveries: newDeliveryCache(opts.DeliveryIDs),
+		ctx:        ctx,
+		cancel:     cancel,
+		logger:     logger,
+	}, nil
+}
+
+// Start starts the workers and marks the server as ready
+func (s *Server) Start() {
+	for i := 0; i < s.opts.Workers; i++ {
+		s.workers.Add(1)
+		go s.work()
+	}
+	s.ready.Store(true)
+}
+
+// Shutdown stops accepting webhooks and waits for the queued events to be handled.
+// When ctx is done first, the running handlers are canceled and ctx.Err() is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.ready.Store(false)
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		s.cancel()
+		return nil
+	case <-ctx.Done():
+		s.cancel()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// Handler returns the HTTP handler with the webhook endpoint (/webhook) and the health (/healthz) and readiness (/readyz) endpoints
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /webhook", s.serveWebhook)
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "ok\n")
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !s.ready.Load() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = io.WriteString(w, "ok\n")
+	})
+	return mux
+}
+
+// ListenAndServe serves on addr until ctx is done, then shuts down gracefully, waiting at most shutdownTimeout for the running commands
+func (s *Server) ListenAndServe(ctx context.Context, addr string, shutdownTimeout time.Duration) error {
+	httpServer := &http.Server{
+		Addr:              addr,
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	s.Start()
+
+	errCh := make(chan error, 1)
+	go func() {
+		s.logger.Printf("Listening on %s", addr)
+		errCh <- httpServer.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errCh:
+		_ = s.Shutdown(context.Background())
+		return fmt.Errorf("listening on %s: %w", addr, err)
+	case <-ctx.Done():
+	}
+
+	s.logger.Println("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("shutting down the HTTP server: %w", err)
+	}
+	if err := s.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("waiting for running commands: %w", err)
+	}
+	return nil
+}
+
+func (s *Server) serveWebhook(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, s.opts.MaxBodyBytes))
+	if err != nil {
+		http.Error(w, "failed to read the body", http.StatusBadRequest)
+		return
+	}
+	if !VerifySignature(s.opts.Secret, body, r.Header.Get("X-Hub-Signature-256")) {
+		s.logger.Printf("Rejected a delivery with an invalid signature from %s", r.RemoteAddr)
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	eventName := r.Header.Get("X-GitHub-Event")
+	deliveryID := r.Header.Get("X-GitHub-Delivery")
+	if eventName != "issue_comment" {
+		// e.g. ping, sent when the webhook is created
+		_, _ = fmt.Fprintf(w, "ignored %s event\n", eventName)
+		return
+	}
+	event, err := github.ParseEvent(eventName, body, "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if event.Action != "created" {
+		_, _ = fmt.Fprintf(w, "ignored %s action\n", event.Action)
+		return
+	}
+	if deliveryID != "" && !s.deliveries.add(deliveryID) {
+		s.logger.Printf("Ignored redelivery %s", deliveryID)
+		_, _ = io.WriteString(w, "already received\n")
+		return
+	}
+
+	if err := s.enqueue(job{deliveryID: deliveryID, event: event}); err != nil {
+		// Forget the delivery, so that GitHub can redeliver it
+		s.deliveries.remove(deliveryID)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	_, _ = io.WriteString(w, "accepted\n")
+}
+
+// errBusy is returned by enqueue when no more events can be queued
+var errBusy = errors.New("too many events in the queue")
+
+func (s *Server) enqueue(j job) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return fmt.Errorf("shutting down")
+	}
+	select {
+	case s.queue <- j:
+		return nil
+	default:
+		return errBusy
+	}
+}
+
+func (s *Server) work() {
+	defer s.workers.Done()
+	for j := range s.queue {
+		s.logger.Printf("Handling delivery %s: #%d in %s/%s by @%s", j.deliveryID, j.event.Number, j.event.Owner, j.event.Repo, j.event.Author)
+		if err := s.handle(s.ctx, j.event); err != nil {
+			s.logger.Printf("Delivery %s failed: %v", j.deliveryID, err)
+		}
+	}
+}
+
+// VerifySignature reports whether signature, the X-Hub-Signature-256 header, is the HMAC-SHA256 of body with secret
+func VerifySignature(secret, body []byte, signature string) bool {
+	hexMAC, ok := strings.CutPrefix(signature, "sha256=")
+	if !ok {
+		return false
+	}
+	got, err := hex.DecodeString(hexMAC)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+// deliveryCache remembers the most recent delivery IDs, forgetting the oldest one when it is full
+type deliveryCache struct {
+	mu    sync.Mutex
+	ids   map[string]struct{}
+	order []string
+	size  int
+}
+
+func newDeliveryCache(size int) *deliveryCache {
+	return &deliveryCache{ids: make(map[string]struct{}, size), size: size}
+}
+
+// add records id and reports whether it was not seen before
+func (c *deliveryCache) add(id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.ids[id]; ok {
+		return false
+	}
+	if len(c.order) >= c.size {
+		delete(c.ids, c.order[0])
+		c.order = c.order[1:]
+	}
+	c.ids[id] = struct{}{}
+	c.order = append(c.order, id)
+	return true
+}
+
+func (c *deliveryCache) remove(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.ids[id]; !ok {
+		return
+	}
+	delete(c.ids, id)
+	for i, v := range c.order {
+		if v == id {
+			c.order = append(c.order[:i], c.order[i+1:]...)
+			break
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/3-shake/alert-menta/internal/github"
+)
+
+const testSecret = "secret"
+
+const commentPayload = `{"action":"created","issue":{"number":12},"comment":{"body":"/describe","author_association":"MEMBER","user":{"login":"bob"}},` +
+	`"repository":{"name":"repo","owner":{"login":"owner"}}}`
+
+// sign returns the X-Hub-Signature-256 header of body
+func sign(body string) string {
+	mac := hmac.New(sha256.New, []byte(testSecret))
+	mac.Write([]byte(body))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// postWebhook sends a webhook to the handler and returns the status code
+func postWebhook(t *testing.T, handler http.Handler, event, deliveryID, body, signature string) int {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(body))
+	req.Header.Set("X-GitHub-Event", event)
+	req.Header.Set("X-GitHub-Delivery", deliveryID)
+	req.Header.Set("X-Hub-Signature-256", signature)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+// TestVerifySignature tests the HMAC-SHA256 signature check
+func TestVerifySignature(t *testing.T) {
+	tests := []struct {
+		name      string
+		signature string
+		expected  bool
+	}{
+		{"Valid", sign("body"), true},
+		{"Other body", sign("other"), false},
+		{"Missing prefix", strings.TrimPrefix(sign("body"), "sha256="), false},
+		{"Not hex", "sha256=zz", false},
+		{"Empty", "", false},
+	}
+
+	for _, tt := range tests {
+		if got := VerifySignature([]byte(testSecret), []byte("body"), tt.signature); got != tt.expected {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.expected, got)
+		}
+	}
+}
+
+// TestServeWebhook tests that valid comments are handled once, and everything else is refused or ignored
+func TestServeWebhook(t *testing.T) {
+	var mu sync.Mutex
+	var handled []*github.Event
+	done := make(chan struct{}, 10)
+	srv, err := New(Options{Secret: []byte(testSecret)}, func(ctx context.Context, event *github.Event) error {
+		mu.Lock()
+		handled = append(handled, event)
+		mu.Unlock()
+		done <- struct{}{}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("New returned an error: %v", err)
+	}
+	srv.Start()
+	handler := srv.Handler()
+
+	edited := strings.Replace(commentPayload, `"created"`, `"edited"`, 1)
+	tests := []struct {
+		name       string
+		event      string
+		deliveryID string
+		body       string
+		signature  string
+		expected   int
+	}{
+		{"Invalid signature", "issue_comment", "1", commentPayload, sign("other"), http.StatusUnauthorized},
+		{"Ping", "ping", "2", `{"zen":"Keep it logically awesome."}`, sign(`{"zen":"Keep it logically awesome."}`), http.StatusOK},
+		{"Edited comment", "issue_comment", "3", edited, sign(edited), http.StatusOK},
+		{"Invalid payload", "issue_comment", "4", "{}", sign("{}"), http.StatusBadRequest},
+		{"Created comment", "issue_comment", "5", commentPayload, sign(commentPayload), http.StatusAccepted},
+		{"Redelivery", "issue_comment", "5", commentPayload, sign(commentPayload), http.StatusOK},
+	}
+	for _, tt := range tests {
+		if got := postWebhook(t, handler, tt.event, tt.deliveryID, tt.body, tt.signature); got != tt.expected {
+			t.Errorf("%s: expected status %d, got %d", tt.name, tt.expected, got)
+		}
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the event was not handled")
+	}
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown returned an error: %v", err)
+	}
+	if len(handled) != 1 {
+		t.Fatalf("expected 1 handled event, got %d", len(handled))
+	}
+	if e := handled[0]; e.Owner != "owner" || e.Repo != "repo" || e.Number != 12 || e.CommentBody != "/describe" {
+		t.Errorf("unexpected event %+v", e)
+	}
+}
+
+// TestServeWebhookQueueFull tests that webhooks over the queue size are refused, so that GitHub can redeliver them
+func TestServeWebhookQueueFull(t *testing.T) {
+	release := make(chan struct{})
+	srv, err := New(Options{Secret: []byte(testSecret), Workers: 1, QueueSize: 1}, func(ctx context.Context, event *github.Event) error {
+		<-release
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("New returned an error: %v", err)
+	}
+	// Without workers, the first event stays in the queue
+	handler := srv.Handler()
+
+	if got := postWebhook(t, handler, "issue_comment", "1", commentPayload, sign(commentPayload)); got != http.StatusAccepted {
+		t.Errorf("expected status %d, got %d", http.StatusAccepted, got)
+	}
+	if got := postWebhook(t, handler, "issue_comment", "2", commentPayload, sign(commentPayload)); got != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d, got %d", http.StatusServiceUnavailable, got)
+	}
+	// The refused delivery can be redelivered once there is room
+	srv.Start()
+	close(release)
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown returned an error: %v", err)
+	}
+	if !srv.deliveries.add("2") {
+		t.Error("expected the refused delivery to be forgotten")
+	}
+}
+
+// TestShutdown tests that shutdown waits for running commands, and cancels them when its context is done
+func TestShutdown(t *testing.T) {
+	started := make(chan struct{})
+	srv, err := New(Options{Secret: []byte(testSecret)}, func(ctx context.Context, event *github.Event) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if err != nil {
+		t.Fatalf("New returned an error: %v", err)
+	}
+	srv.Start()
+	handler := srv.Handler()
+
+	if got := postWebhook(t, handler, "issue_comment", "1", commentPayload, sign(commentPayload)); got != http.StatusAccepted {
+		t.Fatalf("expected status %d, got %d", http.StatusAccepted, got)
+	}
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	// Webhooks are refused and the server is not ready after shutdown
+	if got := postWebhook(t, handler, "issue_comment", "2", commentPayload, sign(commentPayload)); got != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d, got %d", http.StatusServiceUnavailable, got)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected /readyz status %d, got %d", http.StatusServiceUnavailable, rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected /healthz status %d, got %d", http.StatusOK, rec.Code)
+	}
+}
+
+// TestNewWithoutSecret tests that a secret is required
+func TestNewWithoutSecret(t *testing.T) {
+	if _, err := New(Options{}, nil); err == nil {
+		t.Error("expected an error without a secret")
+	}
+}
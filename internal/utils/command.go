@@ -0,0 +1,87 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// ErrNotSlashCommand is returned by ParseSlashCommand when the comment does not start with "/"
+var ErrNotSlashCommand = errors.New("comment is not a slash command")
+
+// SlashCommand is a command written in an Issue comment, e.g. "/ask --lang=ja Why did the deploy fail?"
+type SlashCommand struct {
+	Name string
+	// Text after the command and its options. It may span several lines.
+	Intent string
+	// Options given as --key=value. An option without a value, e.g. --verbose, is "true".
+	Options map[string]string
+}
+
+// ParseSlashCommand parses a comment body into a command, its options and the intent.
+// Options must come right after the command, and the intent is the rest of the comment with its line breaks kept.
+// A value with spaces can be quoted, e.g. --title="Disk full".
+func ParseSlashCommand(body string) (*SlashCommand, error) {
+	body = strings.TrimSpace(strings.ReplaceAll(body, "\r\n", "\n"))
+	rest, ok := strings.CutPrefix(body, "/")
+	if !ok {
+		return nil, ErrNotSlashCommand
+	}
+
+	name, rest := cutWord(rest)
+	if name == "" {
+		return nil, fmt.Errorf("no command name after '/'")
+	}
+	cmd := &SlashCommand{Name: name, Options: map[string]string{}}
+
+	for {
+		// Options are only read from the first line
+		trimmed := strings.TrimLeft(rest, " \t")
+		if !strings.HasPrefix(trimmed, "--") {
+			break
+		}
+		var key, value string
+		var err error
+		key, value, rest, err = cutOption(trimmed[2:])
+		if err != nil {
+			return nil, err
+		}
+		if key == "" {
+			return nil, fmt.Errorf("option without a name in %q", trimmed)
+		}
+		cmd.Options[key] = value
+	}
+
+	cmd.Intent = strings.TrimSpace(rest)
+	return cmd, nil
+}
+
+// cutWord returns the text up to the first whitespace and the text after it
+func cutWord(s string) (string, string) {
+	i := strings.IndexFunc(s, unicode.IsSpace)
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], s[i:]
+}
+
+// cutOption parses "key=value rest", "key=\"quoted value\" rest" or "key rest"
+func cutOption(s string) (string, string, string, error) {
+	i := strings.IndexFunc(s, func(r rune) bool { return r == '=' || unicode.IsSpace(r) })
+	if i < 0 || s[i] != '=' {
+		key, rest := cutWord(s)
+		return key, "true", rest, nil
+	}
+
+	key, s := s[:i], s[i+1:]
+	if quote := s[:min(len(s), 1)]; quote == `"` || quote == "'" {
+		end := strings.Index(s[1:], quote)
+		if end < 0 {
+			return "", "", "", fmt.Errorf("unterminated quote in option --%s", key)
+		}
+		return key, s[1 : end+1], s[end+2:], nil
+	}
+	value, rest := cutWord(s)
+	return key, value, rest, nil
+}
@@ -0,0 +1,118 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// DefaultAllowedImageHosts are the hosts that serve images attached to Issues and comments.
+// A leading "*." matches any subdomain.
+var DefaultAllowedImageHosts = []string{"github.com", "*.githubusercontent.com"}
+
+// DefaultImageTokenHosts are the hosts that receive the GitHub token, as private attachments require it
+var DefaultImageTokenHosts = []string{"github.com", "*.githubusercontent.com"}
+
+const maxImageRedirects = 10
+
+// Addresses that are not private or link-local but still must not be reached from a comment
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("100.64.0.0/10"), // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),  // IETF protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"), // benchmarking
+}
+
+// MatchHost reports whether host matches one of the patterns. A pattern "*.example.com" matches subdomains of example.com.
+func MatchHost(host string, patterns []string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, p := range patterns {
+		p = strings.ToLower(p)
+		if suffix, ok := strings.CutPrefix(p, "*."); ok {
+			if strings.HasSuffix(host, "."+suffix) {
+				return true
+			}
+		} else if host == p {
+			return true
+		}
+	}
+	return false
+}
+
+// isPublicAddr reports whether addr is a public unicast address
+func isPublicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+	for _, p := range blockedPrefixes {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkImageURL returns an ErrImageRejected error if u may not be downloaded with opts
+func checkImageURL(u *url.URL, opts ImageOptions) error {
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return fmt.Errorf("%w: scheme %q is not allowed", ErrImageRejected, u.Scheme)
+	}
+	if !MatchHost(u.Hostname(), opts.AllowedHosts) {
+		return fmt.Errorf("%w: host %s is not allowed", ErrImageRejected, u.Hostname())
+	}
+	return nil
+}
+
+// sendsToken reports whether the GitHub token may be sent to u. The host must be both allowed and a token host.
+func sendsToken(u *url.URL, opts ImageOptions) bool {
+	return u.Scheme == "https" && MatchHost(u.Hostname(), opts.AllowedHosts) && MatchHost(u.Hostname(), opts.TokenHosts)
+}
+
+// newImageClient returns an HTTP client that only connects to public addresses, unless opts.AllowPrivateNetworks is set,
+// and only follows redirects to allowed hosts
+func newImageClient(opts ImageOptions) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		// The address is checked after DNS resolution, so that a public name pointing at an internal address is also blocked
+		Control: func(network, address string, _ syscall.RawConn) error {
+			if opts.AllowPrivateNetworks {
+				return nil
+			}
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return fmt.Errorf("%w: invalid address %s", ErrImageRejected, address)
+			}
+			if !isPublicAddr(addrPort.Addr()) {
+				return fmt.Errorf("%w: address %s is not public", ErrImageRejected, addrPort.Addr())
+			}
+			return nil
+		},
+	}
+
+	return &http.Client{
+		Timeout: 15 * time.Second,
+		Transport: &http.Transport{
+			// Connect directly, as a proxy would bypass the address check
+			Proxy:               nil,
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxImageRedirects {
+				return fmt.Errorf("%w: stopped after %d redirects", ErrImageRejected, maxImageRedirects)
+			}
+			if err := checkImageURL(req.URL, opts); err != nil {
+				return err
+			}
+			if !sendsToken(req.URL, opts) {
+				req.Header.Del("Authorization")
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,122 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// References in configuration values: ${NAME} is the environment variable NAME, ${file:/path} is the content of the file,
+// and $${ is a literal "${"
+var referenceRe = regexp.MustCompile(`\$\$\{|\$\{([^}]*)\}`)
+
+// ExpandReferences replaces the ${NAME} and ${file:/path} references in s.
+// Unset variables and unreadable files are errors, so that a missing secret is not silently replaced with "".
+func ExpandReferences(s string) (string, error) {
+	var firstErr error
+	expanded := referenceRe.ReplaceAllStringFunc(s, func(ref string) string {
+		if ref == "$${" {
+			return "${"
+		}
+		name := ref[2 : len(ref)-1]
+		if path, ok := strings.CutPrefix(name, "file:"); ok {
+			data, err := os.ReadFile(path)
+			if err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("reading %s: %w", ref, err)
+			}
+			// Secret files usually end with a line break
+			return strings.TrimRight(string(data), "\r\n")
+		}
+		value, ok := os.LookupEnv(name)
+		if !ok && firstErr == nil {
+			firstErr = fmt.Errorf("environment variable %s is not set", name)
+		}
+		return value
+	})
+	if firstErr != nil {
+		return "", firstErr
+	}
+	return expanded, nil
+}
+
+// expandConfig replaces the references in every string of cfg, including the values of maps and lists.
+// In the sections of providers that are not used, unset references are replaced with "", so that e.g. the api_key
+// of the sample configuration does not have to be set for other providers.
+func expandConfig(cfg *Config) error {
+	sections := map[string]reflect.Value{
+		"openai":       reflect.ValueOf(&cfg.Ai.OpenAI).Elem(),
+		"vertexai":     reflect.ValueOf(&cfg.Ai.VertexAI).Elem(),
+		"anthropic":    reflect.ValueOf(&cfg.Ai.Anthropic).Elem(),
+		"azure_openai": reflect.ValueOf(&cfg.Ai.AzureOpenAI).Elem(),
+	}
+	skip := make(map[string]bool, len(sections))
+	for provider := range sections {
+		skip["ai."+provider] = true
+	}
+	// The providers in use are known once the rest is expanded
+	if err := expandValue(reflect.ValueOf(cfg).Elem(), "", skip, false); err != nil {
+		return err
+	}
+	used := usedProviders(cfg)
+	for provider, section := range sections {
+		if err := expandValue(section, "ai."+provider, nil, !used[provider]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// usedProviders returns the providers of ai.provider, ai.fallback_providers and the commands
+func usedProviders(cfg *Config) map[string]bool {
+	used := map[string]bool{cfg.Ai.Provider: true}
+	for _, provider := range cfg.Ai.FallbackProviders {
+		used[provider] = true
+	}
+	for _, command := range cfg.Ai.Commands {
+		used[command.Provider] = true
+	}
+	return used
+}
+
+// expandValue expands the strings in v, except under the paths in skip. If lenient is true, references that cannot be
+// expanded leave the string empty instead of being an error.
+func expandValue(v reflect.Value, path string, skip map[string]bool, lenient bool) error {
+	if skip[path] {
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		expanded, err := ExpandReferences(v.String())
+		if err != nil && !lenient {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		v.SetString(expanded)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			name, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("yaml"), ",")
+			if err := expandValue(v.Field(i), joinPath(path, name), skip, lenient); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			if err := expandValue(v.Index(i), fmt.Sprintf("%s[%d]", path, i), skip, lenient); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		// Map values are not addressable, so they are replaced with expanded copies
+		iter := v.MapRange()
+		for iter.Next() {
+			value := reflect.New(iter.Value().Type()).Elem()
+			value.Set(iter.Value())
+			if err := expandValue(value, joinPath(path, iter.Key().String()), skip, lenient); err != nil {
+				return err
+			}
+			v.SetMapIndex(iter.Key(), value)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+)
+
+// Images larger than this in either dimension are downscaled before they are sent to the model
+const MaxImageDimension = 2048
+
+// Images with more pixels than this are rejected without decoding, as decoding allocates memory for every pixel
+const MaxImagePixels = 40_000_000
+
+const downscaledJPEGQuality = 85
+
+// DownscaleImage shrinks PNG and JPEG images so that neither side exceeds maxDimension, keeping the aspect ratio.
+// Other formats and images within the limit are returned unchanged.
+// Images over MaxImagePixels return an ErrImageRejected error.
+func DownscaleImage(data []byte, ext string, maxDimension int) ([]byte, error) {
+	if (ext != "png" && ext != "jpeg") || maxDimension <= 0 {
+		return data, nil
+	}
+
+	// Check the size without decoding the whole image
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode the image config: %w", err)
+	}
+	// A small file can declare a huge image, e.g. a compressed PNG of zeros
+	if int64(cfg.Width)*int64(cfg.Height) > MaxImagePixels {
+		return nil, fmt.Errorf("%w: %dx%d exceeds the limit of %d pixels", ErrImageRejected, cfg.Width, cfg.Height, MaxImagePixels)
+	}
+	if cfg.Width <= maxDimension && cfg.Height <= maxDimension {
+		return data, nil
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode the image: %w", err)
+	}
+	width, height := maxDimension, maxDimension
+	if cfg.Width > cfg.Height {
+		height = max(cfg.Height*maxDimension/cfg.Width, 1)
+	} else {
+		width = max(cfg.Width*maxDimension/cfg.Height, 1)
+	}
+	dst := resizeImage(src, width, height)
+
+	var buf bytes.Buffer
+	if ext == "png" {
+		err = png.Encode(&buf, dst)
+	} else {
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: downscaledJPEGQuality})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode the downscaled image: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// resizeImage downscales src to width x height by averaging the source pixels that fall into each destination pixel
+func resizeImage(src image.Image, width, height int) *image.NRGBA {
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	b := src.Bounds()
+	for y := 0; y < height; y++ {
+		y0 := b.Min.Y + y*b.Dy()/height
+		y1 := max(b.Min.Y+(y+1)*b.Dy()/height, y0+1)
+		for x := 0; x < width; x++ {
+			x0 := b.Min.X + x*b.Dx()/width
+			x1 := max(b.Min.X+(x+1)*b.Dx()/width, x0+1)
+
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					c := color.NRGBA64Model.Convert(src.At(sx, sy)).(color.NRGBA64)
+					r += uint64(c.R)
+					g += uint64(c.G)
+					bl += uint64(c.B)
+					a += uint64(c.A)
+					n++
+				}
+			}
+			dst.Set(x, y, color.NRGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(bl / n), A: uint16(a / n)}) //nolint:gosec // averages of uint16 values fit in uint16
+		}
+	}
+	return dst
+}
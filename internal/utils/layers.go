@@ -0,0 +1,147 @@
+package utils
+
+import (
+	"bytes"
+	_ "embed"
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Built-in configuration, which is the first layer of every configuration
+//
+//go:embed default.yaml
+var defaultConfig []byte
+
+// DefaultConfigName is the name of the built-in configuration in errors
+const DefaultConfigName = "built-in defaults"
+
+// ConfigSource is a configuration file, e.g. the organization or the repository file. Name is used in errors.
+type ConfigSource struct {
+	Name string
+	Data []byte
+}
+
+// DefaultConfigSource returns the built-in configuration
+func DefaultConfigSource() ConfigSource {
+	return ConfigSource{Name: DefaultConfigName, Data: defaultConfig}
+}
+
+// MergeConfig merges the sources in order, each one over the previous ones:
+//   - mappings are merged key by key, and ai.commands by command name, so that a layer can change one setting of a command
+//   - other values, including lists, replace the value of the previous layers, e.g. ai.provider
+//   - null removes the value of the previous layers, e.g. a command that the repository does not want
+//
+// Keys are lowercased, as viper does. The result is a YAML document.
+func MergeConfig(sources ...ConfigSource) ([]byte, error) {
+	merged := make(map[string]any)
+	for _, source := range sources {
+		var layer any
+		if err := yaml.Unmarshal(source.Data, &layer); err != nil {
+			return nil, fmt.Errorf("%s: %w", source.Name, err)
+		}
+		if layer == nil {
+			// An empty file changes nothing
+			continue
+		}
+		normalized, ok := normalizeLayer(layer, "").(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("%s: the configuration must be a mapping", source.Name)
+		}
+		mergeLayer(merged, normalized)
+	}
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(merged); err != nil {
+		return nil, fmt.Errorf("error encoding merged config: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// normalizeLayer lowercases the keys of mappings, and turns the list form of ai.commands into a mapping
+func normalizeLayer(value any, path string) any {
+	switch v := value.(type) {
+	case map[string]any:
+		normalized := make(map[string]any, len(v))
+		for key, item := range v {
+			key = strings.ToLower(key)
+			normalized[key] = normalizeLayer(item, joinPath(path, key))
+		}
+		return normalized
+	case map[any]any:
+		normalized := make(map[string]any, len(v))
+		for key, item := range v {
+			name := strings.ToLower(fmt.Sprint(key))
+			normalized[name] = normalizeLayer(item, joinPath(path, name))
+		}
+		return normalized
+	case []any:
+		if path == "ai.commands" {
+			commands := make(map[string]any)
+			for _, item := range v {
+				if command, ok := normalizeLayer(item, path).(map[string]any); ok {
+					for name, settings := range command {
+						commands[name] = settings
+					}
+				}
+			}
+			return commands
+		}
+		normalized := make([]any, len(v))
+		for i, item := range v {
+			normalized[i] = normalizeLayer(item, fmt.Sprintf("%s[%d]", path, i))
+		}
+		return normalized
+	}
+	return value
+}
+
+// mergeLayer merges layer into dst
+func mergeLayer(dst, layer map[string]any) {
+	for key, value := range layer {
+		if value == nil {
+			delete(dst, key)
+			continue
+		}
+		valueMap, isMap := value.(map[string]any)
+		dstMap, dstIsMap := dst[key].(map[string]any)
+		if isMap && dstIsMap {
+			mergeLayer(dstMap, valueMap)
+			continue
+		}
+		dst[key] = value
+	}
+}
+
+// ValidateConfigSources checks each source with ValidateConfigLayer, and then that the merged configuration is complete,
+// e.g. that every command has a system prompt. The problems are returned as a *ValidationError.
+func ValidateConfigSources(sources ...ConfigSource) error {
+	for _, source := range sources {
+		if errs := ValidateConfigLayer(source.Data); len(errs) > 0 {
+			return &ValidationError{Filename: source.Name, Errors: errs}
+		}
+	}
+	merged, err := MergeConfig(sources...)
+	if err != nil {
+		return err
+	}
+	if errs := ValidateConfig(merged); len(errs) > 0 {
+		// Positions in the merged document do not match any file
+		for _, err := range errs {
+			err.Line, err.Column = 0, 0
+		}
+		return &ValidationError{Filename: "merged configuration", Errors: errs}
+	}
+	return nil
+}
+
+// LoadConfig loads the sources merged in order, see MergeConfig. The first source is usually DefaultConfigSource().
+func LoadConfig(sources ...ConfigSource) (*Config, error) {
+	merged, err := MergeConfig(sources...)
+	if err != nil {
+		return nil, err
+	}
+	return newConfigFromYAML(merged)
+}
@@ -0,0 +1,176 @@
+package utils
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// markdownBlock is a paragraph, a fenced code block or a table. head is repeated and tail is added
+// when the block has to be split, so that each part is still a valid code block or table.
+type markdownBlock struct {
+	head string
+	body []string
+	tail string
+}
+
+func (b markdownBlock) String() string {
+	return b.head + strings.Join(b.body, "") + b.tail
+}
+
+// SplitMarkdown splits text into chunks of at most maxLen characters. Chunks end between paragraphs,
+// code blocks and tables, so that none of them is cut. A code block longer than maxLen is closed and reopened,
+// a table longer than maxLen repeats its header, and a paragraph longer than maxLen is split between lines.
+// There is always at least one chunk, which is "" for text of blank lines only.
+func SplitMarkdown(text string, maxLen int) []string {
+	if utf8.RuneCountInString(text) <= maxLen {
+		return []string{text}
+	}
+
+	var chunks []string
+	var current strings.Builder
+	flush := func() {
+		if chunk := strings.Trim(current.String(), "\n"); chunk != "" {
+			chunks = append(chunks, chunk)
+		}
+		current.Reset()
+	}
+	for _, block := range markdownBlocks(text) {
+		for _, part := range block.split(maxLen) {
+			if utf8.RuneCountInString(current.String())+utf8.RuneCountInString(part) > maxLen {
+				flush()
+			}
+			current.WriteString(part)
+		}
+	}
+	flush()
+	if len(chunks) == 0 {
+		return []string{""}
+	}
+	return chunks
+}
+
+// markdownBlocks splits text into blocks. Blank lines are blocks of their own.
+func markdownBlocks(text string) []markdownBlock {
+	lines := strings.SplitAfter(text, "\n")
+	var blocks []markdownBlock
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		switch {
+		case codeFence(line) != "":
+			fence := codeFence(line)
+			block := markdownBlock{head: line, tail: fence + "\n"}
+			for i++; i < len(lines); i++ {
+				if closesFence(lines[i], fence) {
+					block.tail = lines[i]
+					i++
+					break
+				}
+				block.body = append(block.body, lines[i])
+			}
+			blocks = append(blocks, block)
+		case isTableRow(line):
+			block := markdownBlock{head: line}
+			i++
+			if i < len(lines) && isTableRow(lines[i]) {
+				// The delimiter row, e.g. |---|---|
+				block.head += lines[i]
+				i++
+			}
+			for ; i < len(lines) && isTableRow(lines[i]); i++ {
+				block.body = append(block.body, lines[i])
+			}
+			blocks = append(blocks, block)
+		case strings.TrimSpace(line) == "":
+			blocks = append(blocks, markdownBlock{body: []string{line}})
+			i++
+		default:
+			var block markdownBlock
+			for ; i < len(lines) && strings.TrimSpace(lines[i]) != "" && codeFence(lines[i]) == "" && !isTableRow(lines[i]); i++ {
+				block.body = append(block.body, lines[i])
+			}
+			blocks = append(blocks, block)
+		}
+	}
+	return blocks
+}
+
+// split returns the block as parts of at most maxLen characters, each with the head and tail of the block
+func (b markdownBlock) split(maxLen int) []string {
+	text := b.String()
+	if utf8.RuneCountInString(text) <= maxLen {
+		return []string{text}
+	}
+	head, tail := b.head, b.tail
+	if !strings.HasSuffix(tail, "\n") && tail != "" {
+		// The code block closes the text, it needs a line break before the chunk label
+		tail += "\n"
+	}
+	room := maxLen - utf8.RuneCountInString(head) - utf8.RuneCountInString(tail)
+	if room <= 0 {
+		// Too small to repeat the head, the lines are split as they are
+		head, tail, room = "", "", maxLen
+	}
+
+	var parts []string
+	var current strings.Builder
+	flush := func() {
+		if current.Len() > 0 {
+			parts = append(parts, head+current.String()+tail)
+			current.Reset()
+		}
+	}
+	for _, line := range b.body {
+		for _, piece := range splitRunes(line, room) {
+			if utf8.RuneCountInString(current.String())+utf8.RuneCountInString(piece) > room {
+				flush()
+			}
+			current.WriteString(piece)
+		}
+	}
+	flush()
+	if len(parts) == 0 {
+		return []string{text}
+	}
+	return parts
+}
+
+// splitRunes splits s into pieces of at most n characters
+func splitRunes(s string, n int) []string {
+	var pieces []string
+	for utf8.RuneCountInString(s) > n {
+		i := 0
+		for count := 0; count < n; count++ {
+			_, size := utf8.DecodeRuneInString(s[i:])
+			i += size
+		}
+		pieces = append(pieces, s[:i])
+		s = s[i:]
+	}
+	return append(pieces, s)
+}
+
+// codeFence returns the fence that opens a fenced code block on line, e.g. "```", or "" if there is none
+func codeFence(line string) string {
+	trimmed := strings.TrimLeft(line, " ")
+	if len(line)-len(trimmed) > 3 {
+		return ""
+	}
+	for _, c := range []string{"`", "~"} {
+		fence := trimmed[:len(trimmed)-len(strings.TrimLeft(trimmed, c))]
+		if len(fence) >= 3 {
+			return fence
+		}
+	}
+	return ""
+}
+
+// closesFence reports whether line closes the code block opened with fence
+func closesFence(line, fence string) bool {
+	trimmed := strings.TrimSpace(line)
+	return strings.HasPrefix(trimmed, fence) && strings.Trim(trimmed, fence[:1]) == ""
+}
+
+// isTableRow reports whether line is a row of a table
+func isTableRow(line string) bool {
+	return strings.HasPrefix(strings.TrimSpace(line), "|")
+}
@@ -0,0 +1,140 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+)
+
+// PromptData is what the system_prompt and user_template of commands can refer to, e.g. {{ .Issue.Title }}
+type PromptData struct {
+	Issue PromptIssue
+	// Comments on the Issue, and review comments on pull requests, from the oldest. Comments that do not fit ai.max_input_tokens are left out.
+	Comments []PromptComment
+	// Number of the oldest comments that were left out
+	OmittedComments int
+	// Changed files, commits and diff of a pull request, or "" for an Issue
+	PullRequest string
+	// Question or instructions after the command, e.g. for /ask
+	Intent  string
+	Options map[string]string
+	Command string
+	// Repository as "owner/repo"
+	Repo string
+	Now  time.Time
+}
+
+type PromptIssue struct {
+	Number int
+	Title  string
+	// Body, followed by the notes about its attached images
+	Body   string
+	Author string
+	Labels []string
+	State  string
+	URL    string
+}
+
+type PromptComment struct {
+	Author string
+	// Body, followed by the notes about its attached images
+	Body string
+	// File of a review comment on a pull request, "" for other comments
+	Path      string
+	CreatedAt time.Time
+}
+
+// promptFuncs are the functions available in prompt templates
+var promptFuncs = template.FuncMap{
+	// truncate cuts s to n characters, e.g. {{ .Issue.Body | truncate 2000 }}
+	"truncate": func(n int, s string) string {
+		runes := []rune(s)
+		if n < 0 || len(runes) <= n {
+			return s
+		}
+		return string(runes[:n]) + "…"
+	},
+	// last returns the n newest comments, e.g. {{ range last 5 .Comments }}
+	"last": func(n int, comments []PromptComment) []PromptComment {
+		if n < 0 || len(comments) <= n {
+			return comments
+		}
+		return comments[len(comments)-n:]
+	},
+	"join":  strings.Join,
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+}
+
+// ParsePromptTemplate parses a prompt written as a Go template (https://pkg.go.dev/text/template) with the prompt functions
+func ParsePromptTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Funcs(promptFuncs).Option("missingkey=error").Parse(text)
+}
+
+// RenderPrompt parses and executes a prompt template with data
+func RenderPrompt(name, text string, data *PromptData) (string, error) {
+	tmpl, err := ParsePromptTemplate(name, text)
+	if err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	if err := tmpl.Execute(&sb, data); err != nil {
+		return "", fmt.Errorf("executing %s: %w", name, err)
+	}
+	return sb.String(), nil
+}
+
+// UsesField reports whether the template refers to the field of the data, e.g. "Intent" for {{ .Intent }}
+func UsesField(tmpl *template.Template, field string) bool {
+	if tmpl.Tree == nil {
+		return false
+	}
+	return usesField(tmpl.Root, field)
+}
+
+func usesField(node parse.Node, field string) bool {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return false
+		}
+		for _, child := range n.Nodes {
+			if usesField(child, field) {
+				return true
+			}
+		}
+	case *parse.ActionNode:
+		return usesField(n.Pipe, field)
+	case *parse.IfNode:
+		return usesField(n.Pipe, field) || usesField(n.List, field) || usesField(n.ElseList, field)
+	case *parse.RangeNode:
+		return usesField(n.Pipe, field) || usesField(n.List, field) || usesField(n.ElseList, field)
+	case *parse.WithNode:
+		return usesField(n.Pipe, field) || usesField(n.List, field) || usesField(n.ElseList, field)
+	case *parse.TemplateNode:
+		return usesField(n.Pipe, field)
+	case *parse.PipeNode:
+		if n == nil {
+			return false
+		}
+		for _, cmd := range n.Cmds {
+			if usesField(cmd, field) {
+				return true
+			}
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			if usesField(arg, field) {
+				return true
+			}
+		}
+	case *parse.FieldNode:
+		return len(n.Ident) > 0 && n.Ident[0] == field
+	case *parse.VariableNode:
+		// $.Intent
+		return len(n.Ident) > 1 && n.Ident[0] == "$" && n.Ident[1] == field
+	}
+	return false
+}
@@ -1,14 +1,17 @@
 package utils
 
 import (
+	"bytes"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
-	"path/filepath"
 	"regexp"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/spf13/viper"
@@ -18,6 +21,7 @@ import (
 type Config struct {
 	System System `yaml:"system"`
 	Ai     Ai     `yaml:"ai"`
+	GitHub GitHub `yaml:"github"`
 }
 
 type System struct {
@@ -28,114 +32,275 @@ type SystemDebug struct {
 	LogLevel string `yaml:"log_level" mapstructure:"log_level"`
 }
 
+type GitHub struct {
+	// API endpoint of a GitHub Enterprise Server, e.g. "https://ghes.example.com/api/v3/". Empty means github.com.
+	BaseURL string `yaml:"base_url" mapstructure:"base_url"`
+	// Upload endpoint of a GitHub Enterprise Server. Defaults to /api/uploads/ on the host of BaseURL.
+	UploadURL    string       `yaml:"upload_url" mapstructure:"upload_url"`
+	Comments     Comments     `yaml:"comments"`
+	PullRequests PullRequests `yaml:"pull_requests" mapstructure:"pull_requests"`
+	// Do not react to the comment with the command (👀 when it starts, then 🚀 or 😕 when it is done)
+	NoReactions bool `yaml:"no_reactions" mapstructure:"no_reactions"`
+	// Post a placeholder comment when a command starts, and replace it with the response
+	Placeholder bool `yaml:"placeholder"`
+	// Author associations that may run commands in -event mode, e.g. ["OWNER", "MEMBER", "COLLABORATOR"]. Defaults to OWNER and MEMBER.
+	AllowedAssociations []string `yaml:"allowed_associations" mapstructure:"allowed_associations"`
+}
+
+// DefaultAllowedAssociations are the author associations that may run commands when github.allowed_associations is not set
+var DefaultAllowedAssociations = []string{"OWNER", "MEMBER"}
+
+// Limits the issue comments included in the prompt
+type Comments struct {
+	// Maximum number of comments. 0 means all comments.
+	Limit int `yaml:"limit"`
+	// Include the newest comments instead of the oldest ones when over the limit
+	MostRecent bool `yaml:"most_recent" mapstructure:"most_recent"`
+}
+
+// DefaultMaxDiffBytes is the size of the pull request diff included in the prompt when github.pull_requests.max_diff_bytes is not set
+const DefaultMaxDiffBytes = 50000
+
+// Limits what is read from pull requests
+type PullRequests struct {
+	// Maximum size of the diff in bytes. 0 uses DefaultMaxDiffBytes, and a negative value leaves the diff out.
+	MaxDiffBytes int `yaml:"max_diff_bytes" mapstructure:"max_diff_bytes"`
+}
+
 type Ai struct {
-	Commands map[string]Command `yaml:"commands"`
-	Provider string             `yaml:"provider"`
-	OpenAI   OpenAI             `yaml:"openai"`
-	VertexAI VertexAI           `yaml:"vertexai"`
+	Commands    map[string]Command `yaml:"commands"`
+	Provider    string             `yaml:"provider"`
+	OpenAI      OpenAI             `yaml:"openai"`
+	VertexAI    VertexAI           `yaml:"vertexai"`
+	Anthropic   Anthropic          `yaml:"anthropic"`
+	AzureOpenAI AzureOpenAI        `yaml:"azure_openai" mapstructure:"azure_openai"`
+	// Providers tried in order when the primary provider fails
+	FallbackProviders []string `yaml:"fallback_providers" mapstructure:"fallback_providers"`
+	// Time to wait for each provider, e.g. "60s". 0 means no timeout.
+	Timeout time.Duration `yaml:"timeout"`
+	// Upper limit of the estimated input tokens. Older comments are dropped from long threads. 0 means no limit.
+	MaxInputTokens int    `yaml:"max_input_tokens" mapstructure:"max_input_tokens"`
+	Images         Images `yaml:"images"`
+}
+
+// Limits of the images attached to the prompt. Unset fields use the defaults.
+type Images struct {
+	// Maximum size of an image in bytes
+	MaxBytes int64 `yaml:"max_bytes" mapstructure:"max_bytes"`
+	// Maximum number of images in the prompt
+	MaxCount int `yaml:"max_count" mapstructure:"max_count"`
+	// Accepted MIME types, e.g. ["image/png", "image/jpeg"]
+	AllowedTypes []string `yaml:"allowed_types" mapstructure:"allowed_types"`
+	// Hosts that images may be downloaded from. "*.example.com" matches subdomains.
+	AllowedHosts []string `yaml:"allowed_hosts" mapstructure:"allowed_hosts"`
+	// Allowed hosts that receive the GitHub token, e.g. a GitHub Enterprise Server. Other hosts are accessed without it.
+	TokenHosts []string `yaml:"token_hosts" mapstructure:"token_hosts"`
+	// Allow downloads from private, loopback and link-local addresses
+	AllowPrivateNetworks bool `yaml:"allow_private_networks" mapstructure:"allow_private_networks"`
 }
 
 type Command struct {
-	Description   string `yaml:"description"`
-	SystemPrompt  string `yaml:"system_prompt" mapstructure:"system_prompt"`
+	Description string `yaml:"description"`
+	// System prompt, as a Go template with PromptData. The intent is appended unless the template refers to .Intent.
+	SystemPrompt string `yaml:"system_prompt" mapstructure:"system_prompt"`
+	// Go template with PromptData for the user prompt. If empty, the title, body and comments of the Issue are used.
+	UserTemplate  string `yaml:"user_template" mapstructure:"user_template"`
 	RequireIntent bool   `yaml:"require_intent" mapstructure:"require_intent"`
+	// Options accepted as --key=value after the command, with their descriptions
+	Options map[string]string `yaml:"options"`
+	// Update the previous response to the command in place instead of posting a new comment
+	Sticky bool `yaml:"sticky"`
+	// Provider for this command instead of ai.provider, and model instead of the model (or Azure OpenAI deployment) of the provider
+	Provider string `yaml:"provider"`
+	Model    string `yaml:"model"`
+	// Generation parameters. Unset parameters use the defaults of the provider.
+	Temperature *float64 `yaml:"temperature"`
+	TopP        *float64 `yaml:"top_p" mapstructure:"top_p"`
+	MaxTokens   int      `yaml:"max_tokens" mapstructure:"max_tokens"`
+	// Only OpenAI and Azure OpenAI support seed
+	Seed *int64 `yaml:"seed"`
 }
 
 type OpenAI struct {
 	Model string `yaml:"model"`
+	// API key as a reference, e.g. "${OPENAI_API_KEY}". The -api-key flag takes precedence.
+	APIKey string `yaml:"api_key" mapstructure:"api_key"`
+	// Endpoint of an OpenAI-compatible API (e.g. vLLM, Ollama, LiteLLM). Defaults to the public OpenAI API.
+	BaseURL string `yaml:"base_url" mapstructure:"base_url"`
+	// Extra headers sent with every request
+	Headers map[string]string `yaml:"headers"`
+	// Allows running without an API key, for endpoints that do not require authentication
+	NoAPIKey bool  `yaml:"no_api_key" mapstructure:"no_api_key"`
+	Retry    Retry `yaml:"retry"`
 }
 
 type VertexAI struct {
 	Model   string `yaml:"model"`
 	Project string `yaml:"project"`
 	Region  string `yaml:"region"`
+	Retry   Retry  `yaml:"retry"`
+}
+
+type AzureOpenAI struct {
+	// e.g. https://{your-resource-name}.openai.azure.com
+	Endpoint   string `yaml:"endpoint"`
+	Deployment string `yaml:"deployment"`
+	// API key as a reference, e.g. "${AZURE_OPENAI_API_KEY}". The -azure-openai-api-key flag takes precedence.
+	// Without a key, Microsoft Entra ID authentication is used.
+	APIKey string `yaml:"api_key" mapstructure:"api_key"`
+	// Defaults to the version bundled with the azopenai SDK
+	APIVersion string `yaml:"api_version" mapstructure:"api_version"`
+	Retry      Retry  `yaml:"retry"`
+}
+
+type Anthropic struct {
+	Model string `yaml:"model"`
+	// API key as a reference, e.g. "${ANTHROPIC_API_KEY}". The -anthropic-api-key flag takes precedence.
+	APIKey    string `yaml:"api_key" mapstructure:"api_key"`
+	MaxTokens int    `yaml:"max_tokens" mapstructure:"max_tokens"`
+	Retry     Retry  `yaml:"retry"`
+}
+
+// Retry policy for rate limit (429) and server (5xx) errors. Unset fields use the defaults.
+type Retry struct {
+	// Total number of attempts, including the first one. 1 disables retries.
+	MaxAttempts int `yaml:"max_attempts" mapstructure:"max_attempts"`
+	// Delay before the first retry, e.g. "2s". It is doubled for each subsequent retry.
+	BaseDelay time.Duration `yaml:"base_delay" mapstructure:"base_delay"`
+	// Upper limit of the delay, e.g. "30s"
+	MaxDelay time.Duration `yaml:"max_delay" mapstructure:"max_delay"`
+	// Fraction of the delay that is added at random (0-1)
+	Jitter float64 `yaml:"jitter"`
+	// Use the backoff delay even if the server sends Retry-After
+	IgnoreRetryAfter bool `yaml:"ignore_retry_after" mapstructure:"ignore_retry_after"`
 }
 
+// NewConfig loads the configuration file over the built-in defaults
 func NewConfig(filename string) (*Config, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file: %w", err)
+	}
+	return LoadConfig(DefaultConfigSource(), ConfigSource{Name: filename, Data: data})
+}
+
+func newConfigFromYAML(data []byte) (*Config, error) {
 	// Initialize a logger
 	logger := log.New(
 		os.Stdout, "[alert-menta utils] ",
 		log.Ldate|log.Ltime|log.Llongfile|log.Lmsgprefix,
 	)
 
-	// Get the directory and file name from variable filename
-	dir, file := filepath.Split(filename)
-	// Extract base part and extension part
-	base, ext := filepath.Base(file)[:len(filepath.Base(file))-len(filepath.Ext(file))], filepath.Ext(file)[1:]
-
-	// Read the config file
-	viper.SetConfigName(base)
-	viper.SetConfigType(ext)
-	viper.AddConfigPath(dir)
-	err := viper.ReadInConfig()
-	if err != nil {
-		return nil, fmt.Errorf("error reading config file: %w", err)
+	// Read the config
+	v := viper.New()
+	v.SetConfigType("yaml")
+	if err := v.ReadConfig(bytes.NewReader(data)); err != nil {
+		return nil, fmt.Errorf("error reading config: %w", err)
 	}
 
-	// Unmarshal the config file
+	// Unmarshal the config
 	cfg := new(Config)
-	err = viper.Unmarshal(cfg)
-	if err != nil {
+	if err := v.Unmarshal(cfg); err != nil {
 		return nil, fmt.Errorf("error unmarshaling config: %w", err)
 	}
 
-	// Print the config
+	// Print the config before the references are expanded, so that secrets are not logged
 	logger.Println("Config:", cfg)
+	if err := expandConfig(cfg); err != nil {
+		return nil, fmt.Errorf("error expanding config: %w", err)
+	}
 	return cfg, nil
 }
 
-func DownloadImage(url string, token string) ([]byte, string, error) {
-	// Create a new HTTP client
-	client := &http.Client{
-		Timeout: 15 * time.Second,
+// ErrImageRejected is returned by DownloadImage when the image violates the ImageOptions limits
+var ErrImageRejected = errors.New("image rejected")
+
+// Defaults of ImageOptions
+const (
+	DefaultMaxImageBytes = 5 << 20
+	DefaultMaxImages     = 10
+)
+
+// DefaultAllowedImageTypes are the image types supported by all providers
+var DefaultAllowedImageTypes = []string{"image/png", "image/jpeg", "image/gif", "image/webp"}
+
+// ImageOptions limits the images downloaded by DownloadImage
+type ImageOptions struct {
+	// Maximum size of an image in bytes
+	MaxBytes int64
+	// MIME types that are accepted, checked against the content rather than the Content-Type header
+	AllowedTypes []string
+	// Hosts that images may be downloaded from, including redirects
+	AllowedHosts []string
+	// Allowed hosts that receive the GitHub token over HTTPS
+	TokenHosts []string
+	// Allow connections to private, loopback and link-local addresses
+	AllowPrivateNetworks bool
+}
+
+// DefaultImageOptions returns the limits used when no image settings are configured
+func DefaultImageOptions() ImageOptions {
+	return ImageOptions{
+		MaxBytes:     DefaultMaxImageBytes,
+		AllowedTypes: DefaultAllowedImageTypes,
+		AllowedHosts: DefaultAllowedImageHosts,
+		TokenHosts:   DefaultImageTokenHosts,
 	}
+}
+
+func DownloadImage(url string, token string, opts ImageOptions) ([]byte, string, error) {
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return []byte{}, "", fmt.Errorf("failed to create a new request: %w", err)
 	}
+	if err := checkImageURL(req.URL, opts); err != nil {
+		return []byte{}, "", err
+	}
 
-	// Download the image with the token
-	req.Header.Set("Authorization", "Bearer "+token) // set token to header
-	resp, err := client.Do(req)
+	// Only token hosts get the token, so that it does not leak to a host linked from a comment
+	if token != "" && sendsToken(req.URL, opts) {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := newImageClient(opts).Do(req)
 	if err != nil {
 		return []byte{}, "", fmt.Errorf("failed to get a response: %w", err)
 	}
 	defer func() { _ = resp.Body.Close() }()
-
-	// Write the response body to the temporary file
-	file, err := os.CreateTemp("", "downloaded-image-*")
-	if err != nil {
-		return []byte{}, "", fmt.Errorf("failed to create a temporary file: %w", err)
-	}
-	defer func() {
-		log.Println("remove", file.Name(), "Content-Type:", resp.Header.Get("Content-Type"))
-		_ = file.Close()
-		_ = os.Remove(file.Name())
-	}()
-	_, err = io.Copy(file, resp.Body)
-	if err != nil {
-		return []byte{}, "", fmt.Errorf("failed to write the response body to the temporary file: %w", err)
+	if resp.StatusCode != http.StatusOK {
+		return []byte{}, "", fmt.Errorf("failed to get the image: unexpected status %d", resp.StatusCode)
 	}
 
-	// Read image data from the temporary file
-	data, err := os.ReadFile(file.Name())
+	if opts.MaxBytes > 0 && resp.ContentLength > opts.MaxBytes {
+		return []byte{}, "", fmt.Errorf("%w: %d bytes exceeds the limit of %d bytes", ErrImageRejected, resp.ContentLength, opts.MaxBytes)
+	}
+	// Read at most one byte more than the limit, so that oversized images are detected without reading them entirely
+	body := io.Reader(resp.Body)
+	if opts.MaxBytes > 0 {
+		body = io.LimitReader(resp.Body, opts.MaxBytes+1)
+	}
+	data, err := io.ReadAll(body)
 	if err != nil {
-		return []byte{}, "", fmt.Errorf("failed to read the file: %w", err)
+		return []byte{}, "", fmt.Errorf("failed to read the response body: %w", err)
+	}
+	if opts.MaxBytes > 0 && int64(len(data)) > opts.MaxBytes {
+		return []byte{}, "", fmt.Errorf("%w: exceeds the limit of %d bytes", ErrImageRejected, opts.MaxBytes)
 	}
 
-	// Get the extension of the image
-	contentType := resp.Header.Get("Content-Type")
-	imageRegex := regexp.MustCompile(`.+/(.*)`)
-	matches := imageRegex.FindAllStringSubmatch(contentType, -1)
-	if len(matches) == 0 {
-		return []byte{}, "", fmt.Errorf("failed to get the extension of the image")
+	// Get the type of the image from its content, as the Content-Type header is not trustworthy
+	contentType := http.DetectContentType(data)
+	if !slices.Contains(opts.AllowedTypes, contentType) {
+		return []byte{}, "", fmt.Errorf("%w: type %s is not allowed (Content-Type: %s)", ErrImageRejected, contentType, resp.Header.Get("Content-Type"))
 	}
-	ext := matches[0][1]
+	ext := strings.TrimPrefix(contentType, "image/")
 
 	return data, ext, nil
 }
 
 func ImageToBase64(data []byte, ext string) string {
+	// Downscaling failures are not fatal, the original image is sent instead
+	if downscaled, err := DownscaleImage(data, ext, MaxImageDimension); err == nil {
+		data = downscaled
+	}
 	base64img := base64.StdEncoding.EncodeToString(data)
 	return "data:image/" + ext + ";base64," + base64img
 }
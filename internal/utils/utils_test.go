@@ -1,8 +1,25 @@
 package utils
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
+	"time"
+	"unicode/utf8"
 )
 
 // TestNewConfig tests the NewConfig function
@@ -14,6 +31,8 @@ system:
     log_level: "debug"
 ai:
   provider: "openai"
+  fallback_providers: ["vertexai", "anthropic"]
+  timeout: "90s"
   openai:
     model: "text-davinci-003"
   commands:
@@ -47,6 +66,12 @@ ai:
 	if cfg.Ai.Provider != "openai" {
 		t.Errorf("Expected provider 'openai', got '%s'", cfg.Ai.Provider)
 	}
+	if len(cfg.Ai.FallbackProviders) != 2 || cfg.Ai.FallbackProviders[0] != "vertexai" {
+		t.Errorf("Expected fallback_providers [vertexai anthropic], got %v", cfg.Ai.FallbackProviders)
+	}
+	if cfg.Ai.Timeout != 90*time.Second {
+		t.Errorf("Expected timeout 90s, got %s", cfg.Ai.Timeout)
+	}
 	if cfg.Ai.OpenAI.Model != "text-davinci-003" {
 		t.Errorf("Expected model 'text-davinci-003', got '%s'", cfg.Ai.OpenAI.Model)
 	}
@@ -57,3 +82,673 @@ ai:
 		t.Errorf("Expected system_prompt 'Prompt', got '%s'", cfg.Ai.Commands["command1"].SystemPrompt)
 	}
 }
+
+// TestParseSlashCommand tests that the command, options and multi-line intent are extracted from a comment
+func TestParseSlashCommand(t *testing.T) {
+	tests := []struct {
+		name            string
+		body            string
+		expectedName    string
+		expectedIntent  string
+		expectedOptions map[string]string
+		expectErr       bool
+	}{
+		{"Command only", "/describe", "describe", "", map[string]string{}, false},
+		{"Intent", "  /ask What is the next action?\r\n", "ask", "What is the next action?", map[string]string{}, false},
+		{"Multi-line intent with quotes", "/ask Why did it fail?\r\nThe log says \"it's `$(rm -rf /)`\"", "ask", "Why did it fail?\nThe log says \"it's `$(rm -rf /)`\"", map[string]string{}, false},
+		{"Options", "/ask --lang=ja --verbose --title=\"Disk full\" What happened?", "ask", "What happened?", map[string]string{"lang": "ja", "verbose": "true", "title": "Disk full"}, false},
+		{"Options only on the first line", "/ask\n--lang=ja", "ask", "--lang=ja", map[string]string{}, false},
+		{"Option after the intent", "/ask What about --lang=ja?", "ask", "What about --lang=ja?", map[string]string{}, false},
+		{"Unterminated quote", "/ask --title=\"Disk full", "", "", nil, true},
+		{"No command name", "/ ask", "", "", nil, true},
+		{"Not a command", "Thanks!", "", "", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd, err := ParseSlashCommand(tt.body)
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("expected error: %v, got %v", tt.expectErr, err)
+			}
+			if err != nil {
+				return
+			}
+			if cmd.Name != tt.expectedName || cmd.Intent != tt.expectedIntent {
+				t.Errorf("expected /%s %q, got /%s %q", tt.expectedName, tt.expectedIntent, cmd.Name, cmd.Intent)
+			}
+			if !maps.Equal(cmd.Options, tt.expectedOptions) {
+				t.Errorf("expected options %v, got %v", tt.expectedOptions, cmd.Options)
+			}
+		})
+	}
+
+	if _, err := ParseSlashCommand("Thanks!"); !errors.Is(err, ErrNotSlashCommand) {
+		t.Errorf("expected ErrNotSlashCommand, got %v", err)
+	}
+}
+
+// TestDownloadImage tests the size and type limits of downloaded images
+func TestDownloadImage(t *testing.T) {
+	pngData := encodeTestImage(t, "png", 8, 8)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/image.png":
+			// The Content-Type header is ignored in favor of the content
+			w.Header().Set("Content-Type", "application/octet-stream")
+			_, _ = w.Write(pngData)
+		case "/page.png":
+			_, _ = w.Write([]byte("<html><body>not an image</body></html>"))
+		case "/missing.png":
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	opts := localImageOptions()
+
+	tests := []struct {
+		name        string
+		path        string
+		opts        ImageOptions
+		expectedExt string
+		rejected    bool
+		expectErr   bool
+	}{
+		{"Allowed image", "/image.png", opts, "png", false, false},
+		{"Too large", "/image.png", ImageOptions{MaxBytes: 10, AllowedTypes: DefaultAllowedImageTypes, AllowedHosts: opts.AllowedHosts, AllowPrivateNetworks: true}, "", true, true},
+		{"Type not allowed", "/image.png", ImageOptions{MaxBytes: DefaultMaxImageBytes, AllowedTypes: []string{"image/jpeg"}, AllowedHosts: opts.AllowedHosts, AllowPrivateNetworks: true}, "", true, true},
+		{"Not an image", "/page.png", opts, "", true, true},
+		{"Not found", "/missing.png", opts, "", false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, ext, err := DownloadImage(server.URL+tt.path, "token", tt.opts)
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("expected error: %v, got %v", tt.expectErr, err)
+			}
+			if errors.Is(err, ErrImageRejected) != tt.rejected {
+				t.Errorf("expected ErrImageRejected: %v, got %v", tt.rejected, err)
+			}
+			if err == nil && (ext != tt.expectedExt || !bytes.Equal(data, pngData)) {
+				t.Errorf("expected the %s image, got %d bytes of %s", tt.expectedExt, len(data), ext)
+			}
+		})
+	}
+}
+
+// localImageOptions returns the default ImageOptions that also allow the local test server
+func localImageOptions() ImageOptions {
+	opts := DefaultImageOptions()
+	opts.AllowedHosts = append([]string{"127.0.0.1"}, opts.AllowedHosts...)
+	opts.AllowPrivateNetworks = true
+	return opts
+}
+
+// TestDownloadImageSSRF tests that images are only downloaded from allowed hosts and public addresses,
+// and that the token is only sent to GitHub
+func TestDownloadImageSSRF(t *testing.T) {
+	pngData := encodeTestImage(t, "png", 8, 8)
+	var authorization string
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/redirect-internal":
+			http.Redirect(w, r, "http://169.254.169.254/latest/meta-data", http.StatusFound)
+		case "/redirect-local":
+			http.Redirect(w, r, server.URL+"/image.png", http.StatusFound)
+		default:
+			authorization = r.Header.Get("Authorization")
+			_, _ = w.Write(pngData)
+		}
+	}))
+	defer server.Close()
+
+	// Private addresses are blocked after DNS resolution, even when the host is allowed
+	opts := localImageOptions()
+	opts.AllowPrivateNetworks = false
+	if _, _, err := DownloadImage(server.URL+"/image.png", "token", opts); !errors.Is(err, ErrImageRejected) {
+		t.Errorf("expected ErrImageRejected for a loopback address, got %v", err)
+	}
+
+	opts = localImageOptions()
+	if _, _, err := DownloadImage("http://example.com/image.png", "token", opts); !errors.Is(err, ErrImageRejected) {
+		t.Errorf("expected ErrImageRejected for a host that is not allowed, got %v", err)
+	}
+	if _, _, err := DownloadImage(server.URL+"/redirect-internal", "token", opts); !errors.Is(err, ErrImageRejected) {
+		t.Errorf("expected ErrImageRejected for a redirect to a host that is not allowed, got %v", err)
+	}
+
+	// The token is not sent to hosts other than GitHub
+	if _, _, err := DownloadImage(server.URL+"/redirect-local", "token", opts); err != nil {
+		t.Fatalf("DownloadImage returned an error: %v", err)
+	}
+	if authorization != "" {
+		t.Errorf("expected no Authorization header, got %q", authorization)
+	}
+}
+
+// TestMatchHost tests exact and wildcard host patterns
+func TestMatchHost(t *testing.T) {
+	tests := []struct {
+		host     string
+		expected bool
+	}{
+		{"github.com", true},
+		{"GitHub.com.", true},
+		{"user-images.githubusercontent.com", true},
+		{"githubusercontent.com", false},
+		{"api.github.com", false},
+		{"github.com.evil.example", false},
+		{"evilgithubusercontent.com", false},
+	}
+
+	for _, tt := range tests {
+		if got := MatchHost(tt.host, DefaultAllowedImageHosts); got != tt.expected {
+			t.Errorf("MatchHost(%s): expected %v, got %v", tt.host, tt.expected, got)
+		}
+	}
+}
+
+// TestSendsToken tests that the token is only sent over HTTPS to hosts that are both allowed and token hosts
+func TestSendsToken(t *testing.T) {
+	opts := DefaultImageOptions()
+	opts.AllowedHosts = []string{"github.com", "*.githubusercontent.com", "ghes.example.com", "images.example.com"}
+	opts.TokenHosts = []string{"github.com", "*.githubusercontent.com", "ghes.example.com", "other.example.com"}
+	tests := []struct {
+		url      string
+		expected bool
+	}{
+		{"https://github.com/user-attachments/assets/a", true},
+		{"https://ghes.example.com/storage/a.png", true},
+		{"http://ghes.example.com/storage/a.png", false},
+		{"https://images.example.com/a.png", false},
+		{"https://other.example.com/a.png", false},
+	}
+
+	for _, tt := range tests {
+		u, err := url.Parse(tt.url)
+		if err != nil {
+			t.Fatalf("url.Parse(%s): %v", tt.url, err)
+		}
+		if got := sendsToken(u, opts); got != tt.expected {
+			t.Errorf("sendsToken(%s): expected %v, got %v", tt.url, tt.expected, got)
+		}
+	}
+}
+
+// TestIsPublicAddr tests that internal addresses are blocked
+func TestIsPublicAddr(t *testing.T) {
+	tests := []struct {
+		addr     string
+		expected bool
+	}{
+		{"140.82.112.3", true},
+		{"2606:50c0:8000::154", true},
+		{"127.0.0.1", false},
+		{"10.0.0.1", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"::1", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"::ffff:10.0.0.1", false},
+	}
+
+	for _, tt := range tests {
+		if got := isPublicAddr(netip.MustParseAddr(tt.addr)); got != tt.expected {
+			t.Errorf("isPublicAddr(%s): expected %v, got %v", tt.addr, tt.expected, got)
+		}
+	}
+}
+
+// TestDownscaleImage tests that large images are shrunk keeping the aspect ratio
+func TestDownscaleImage(t *testing.T) {
+	tests := []struct {
+		name           string
+		ext            string
+		width, height  int
+		expectedWidth  int
+		expectedHeight int
+	}{
+		{"Landscape PNG", "png", 400, 100, 200, 50},
+		{"Portrait JPEG", "jpeg", 100, 400, 50, 200},
+		{"Within the limit", "png", 200, 200, 200, 200},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := DownscaleImage(encodeTestImage(t, tt.ext, tt.width, tt.height), tt.ext, 200)
+			if err != nil {
+				t.Fatalf("DownscaleImage returned an error: %v", err)
+			}
+			cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("Error decoding the downscaled image: %v", err)
+			}
+			if format != tt.ext || cfg.Width != tt.expectedWidth || cfg.Height != tt.expectedHeight {
+				t.Errorf("expected a %dx%d %s, got a %dx%d %s", tt.expectedWidth, tt.expectedHeight, tt.ext, cfg.Width, cfg.Height, format)
+			}
+		})
+	}
+
+	// Images that declare too many pixels are rejected before they are decoded
+	if _, err := DownscaleImage(pngWithSize(t, 50000, 50000), "png", 200); !errors.Is(err, ErrImageRejected) {
+		t.Errorf("expected ErrImageRejected for a 50000x50000 PNG, got %v", err)
+	}
+
+	// Other formats are returned unchanged
+	gif := []byte("GIF89a")
+	if data, err := DownscaleImage(gif, "gif", 200); err != nil || !bytes.Equal(data, gif) {
+		t.Errorf("expected GIF to be unchanged, got %v, %v", data, err)
+	}
+}
+
+// pngWithSize returns a 1x1 PNG whose header declares width x height
+func pngWithSize(t *testing.T, width, height uint32) []byte {
+	t.Helper()
+	data := encodeTestImage(t, "png", 1, 1)
+	// The IHDR chunk follows the 8-byte signature: length (4), type (4), width (4), height (4), ... and a CRC over type and data
+	binary.BigEndian.PutUint32(data[16:20], width)
+	binary.BigEndian.PutUint32(data[20:24], height)
+	binary.BigEndian.PutUint32(data[29:33], crc32.ChecksumIEEE(data[12:29]))
+	return data
+}
+
+// encodeTestImage returns a width x height image in the given format
+func encodeTestImage(t *testing.T, ext string, width, height int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i % 256)
+	}
+	var buf bytes.Buffer
+	var err error
+	if ext == "png" {
+		err = png.Encode(&buf, img)
+	} else {
+		err = jpeg.Encode(&buf, img, nil)
+	}
+	if err != nil {
+		t.Fatalf("Error encoding the test image: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// TestSplitMarkdown tests that long text is split between blocks, and that long code blocks and tables stay valid
+func TestSplitMarkdown(t *testing.T) {
+	codeBlock := "```go\nfunc a() {}\nfunc b() {}\n```"
+	table := "| a | b |\n|---|---|\n| 1 | 2 |\n| 3 | 4 |\n| 5 | 6 |"
+	tests := []struct {
+		name     string
+		text     string
+		maxLen   int
+		expected []string
+	}{
+		{"Short", "Hello\n\nWorld", 100, []string{"Hello\n\nWorld"}},
+		{"Between paragraphs", "First paragraph\n\nSecond paragraph", 20, []string{"First paragraph", "Second paragraph"}},
+		{"Code block kept whole", "Intro\n\n" + codeBlock + "\n\nEnd", 36, []string{"Intro", codeBlock, "End"}},
+		{"Long code block", codeBlock, 22, []string{"```go\nfunc a() {}\n```", "```go\nfunc b() {}\n```"}},
+		{"Long table", table, 40, []string{"| a | b |\n|---|---|\n| 1 | 2 |\n| 3 | 4 |", "| a | b |\n|---|---|\n| 5 | 6 |"}},
+		{"Long line", "ああああああ", 4, []string{"ああああ", "ああ"}},
+		{"Blank lines", strings.Repeat("\n", 10), 4, []string{""}},
+	}
+
+	for _, tt := range tests {
+		got := SplitMarkdown(tt.text, tt.maxLen)
+		if !slices.Equal(got, tt.expected) {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.expected, got)
+		}
+		for _, chunk := range got {
+			if n := utf8.RuneCountInString(chunk); n > tt.maxLen {
+				t.Errorf("%s: chunk of %d characters is over the limit of %d", tt.name, n, tt.maxLen)
+			}
+		}
+	}
+}
+
+// TestValidateConfig tests that mistakes in the configuration are reported with their position
+func TestValidateConfig(t *testing.T) {
+	const valid = `
+ai:
+  provider: openai
+  fallback_providers: [vertexai]
+  timeout: 60s
+  openai:
+    model: gpt-4o-mini
+  vertexai:
+    project: my-project
+    region: us-central1
+    model: gemini-2.0-flash-001
+  commands:
+    describe:
+      system_prompt: "Describe."
+`
+	tests := []struct {
+		name     string
+		config   string
+		expected []string
+	}{
+		{"Valid", valid, nil},
+		{"List of commands", strings.Replace(valid, "    describe:\n      system_prompt: \"Describe.\"\n",
+			"    - describe:\n        system_prompt: \"Describe.\"\n    - ask:\n        system_prompt: \"Answer.\"\n", 1), nil},
+		{"Typo", strings.Replace(valid, "system_prompt", "system_promt", 1), []string{
+			`line 13, column 5: command "describe" has no system_prompt`,
+			`line 14, column 7: unknown key "system_promt" in ai.commands.describe, did you mean "system_prompt"?`,
+		}},
+		{"Duplicate command", valid + "    Describe:\n      system_prompt: \"Again.\"\n", []string{
+			`line 15, column 5: duplicate command "Describe"`,
+		}},
+		{"Unknown provider", strings.Replace(valid, "provider: openai", "provider: openia", 1), []string{
+			`line 3, column 13: unknown provider "openia", expected one of openai, vertexai, anthropic, azure_openai`,
+		}},
+		{"Missing model", strings.Replace(valid, "    model: gemini-2.0-flash-001\n", "", 1), []string{
+			`line 9, column 5: ai.vertexai.model is required to use the vertexai provider`,
+		}},
+		{"Wrong types", strings.Replace(valid, "timeout: 60s", "timeout: soon\n  max_input_tokens: many", 1), []string{
+			`line 5, column 12: ai.timeout must be a duration, e.g. "30s", got "soon"`,
+			`line 6, column 21: ai.max_input_tokens must be a int, got "many"`,
+		}},
+		{"No commands", "ai:\n  provider: anthropic\n  anthropic:\n    model: claude-sonnet-4-5\n", []string{
+			`line 2, column 3: ai.commands must define at least one command`,
+		}},
+		{"Literal API key", strings.Replace(valid, "model: gpt-4o-mini", "model: gpt-4o-mini\n    api_key: sk-secret", 1), []string{
+			`line 8, column 14: ai.openai.api_key must be a reference such as "${ENV_VAR}" or "${file:/path}", not the key itself`,
+		}},
+		{"Invalid template", strings.Replace(valid, `system_prompt: "Describe."`, `system_prompt: "Describe {{ .Issue.Title"`, 1), []string{
+			`line 14, column 22: ai.commands.describe.system_prompt is not a valid template: template: system_prompt:1: unclosed action`,
+		}},
+		{"Command provider", strings.Replace(valid, `system_prompt: "Describe."`, "system_prompt: \"Describe.\"\n      provider: anthropic\n      temperature: 3", 1), []string{
+			`line 15, column 17: ai.anthropic.model is required to use the anthropic provider in ai.commands.describe`,
+			`line 16, column 20: ai.commands.describe.temperature must be between 0 and 2, got 3`,
+		}},
+		{"Command model", strings.Replace(valid, `system_prompt: "Describe."`, "system_prompt: \"Describe.\"\n      provider: anthropic\n      model: claude-haiku-4-5\n      top_p: 0.5\n      seed: 1", 1), nil},
+		{"API key reference", strings.Replace(valid, "model: gpt-4o-mini", "model: gpt-4o-mini\n    api_key: ${OPENAI_API_KEY}", 1), nil},
+		{"Syntax error", "ai:\n  commands:\n    describe:\n      system_prompt: a: b\n", []string{
+			`line 4, column 1: mapping values are not allowed in this context`,
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, err := range ValidateConfig([]byte(tt.config)) {
+				got = append(got, err.Error())
+			}
+			if !slices.Equal(got, tt.expected) {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+// TestValidateConfigFile tests that the template in the repository is valid over the built-in defaults
+func TestValidateConfigFile(t *testing.T) {
+	data, err := os.ReadFile("../../.alert-menta.user.yaml")
+	if err != nil {
+		t.Fatalf("Error reading the template: %v", err)
+	}
+	if err := ValidateConfigSources(DefaultConfigSource(), ConfigSource{Name: ".alert-menta.user.yaml", Data: data}); err != nil {
+		t.Errorf("expected the template to be valid, got %v", err)
+	}
+	var validationErr *ValidationError
+	if err := ValidateConfigSources(DefaultConfigSource(), ConfigSource{Name: "config.yaml", Data: []byte("ai:\n  providr: openai\n")}); !errors.As(err, &validationErr) {
+		t.Errorf("expected a ValidationError, got %v", err)
+	}
+}
+
+// writeTempConfig writes content to a configuration file in a temporary directory and returns its path
+func writeTempConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("Error writing config file: %v", err)
+	}
+	return path
+}
+
+// TestExpandReferences tests the expansion of environment variables and files
+func TestExpandReferences(t *testing.T) {
+	t.Setenv("ALERT_MENTA_TEST_VAR", "value")
+	secretFile := writeTempConfig(t, "secret\n")
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+		wantErr  bool
+	}{
+		{"No reference", "plain $HOME text", "plain $HOME text", false},
+		{"Environment variable", "a-${ALERT_MENTA_TEST_VAR}-b", "a-value-b", false},
+		{"File", "${file:" + secretFile + "}", "secret", false},
+		{"Escaped", "$${ALERT_MENTA_TEST_VAR}", "${ALERT_MENTA_TEST_VAR}", false},
+		{"Unset variable", "${ALERT_MENTA_TEST_UNSET}", "", true},
+		{"Missing file", "${file:/nonexistent/alert-menta}", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ExpandReferences(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error: %v, got %v", tt.wantErr, err)
+			}
+			if got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+// TestNewConfigExpandsReferences tests that the references are expanded in nested strings, lists and maps
+func TestNewConfigExpandsReferences(t *testing.T) {
+	t.Setenv("ALERT_MENTA_TEST_KEY", "sk-test")
+	t.Setenv("ALERT_MENTA_TEST_MODEL", "gpt-4o")
+	t.Setenv("ALERT_MENTA_TEST_TENANT", "sre")
+	filename := writeTempConfig(t, `
+ai:
+  provider: openai
+  fallback_providers: ["${ALERT_MENTA_TEST_MODEL}"]
+  openai:
+    model: ${ALERT_MENTA_TEST_MODEL}
+    api_key: ${ALERT_MENTA_TEST_KEY}
+    headers:
+      X-Tenant: ${ALERT_MENTA_TEST_TENANT}
+  commands:
+    describe:
+      system_prompt: "Model ${ALERT_MENTA_TEST_MODEL}"
+`)
+	cfg, err := NewConfig(filename)
+	if err != nil {
+		t.Fatalf("NewConfig: %v", err)
+	}
+	if cfg.Ai.OpenAI.APIKey != "sk-test" || cfg.Ai.OpenAI.Model != "gpt-4o" {
+		t.Errorf("expected the OpenAI settings to be expanded, got %+v", cfg.Ai.OpenAI)
+	}
+	if cfg.Ai.OpenAI.Headers["x-tenant"] != "sre" {
+		t.Errorf("expected the header to be expanded, got %v", cfg.Ai.OpenAI.Headers)
+	}
+	if cfg.Ai.FallbackProviders[0] != "gpt-4o" {
+		t.Errorf("expected the list to be expanded, got %v", cfg.Ai.FallbackProviders)
+	}
+	if cfg.Ai.Commands["describe"].SystemPrompt != "Model gpt-4o" {
+		t.Errorf("expected the command to be expanded, got %q", cfg.Ai.Commands["describe"].SystemPrompt)
+	}
+
+	cfg.Ai.OpenAI.APIKey = "${ALERT_MENTA_TEST_UNSET}"
+	if err := expandConfig(cfg); err == nil || !strings.Contains(err.Error(), "ai.openai.api_key") {
+		t.Errorf("expected an error naming ai.openai.api_key, got %v", err)
+	}
+}
+
+// TestExpandConfigUnusedProviders tests that unset references only fail in the settings of providers in use
+func TestExpandConfigUnusedProviders(t *testing.T) {
+	cfg := &Config{}
+	cfg.Ai.Provider = "openai"
+	cfg.Ai.OpenAI.Model = "gpt-4o"
+	cfg.Ai.Anthropic.APIKey = "${ALERT_MENTA_TEST_UNSET}"
+	cfg.Ai.AzureOpenAI.APIKey = "${ALERT_MENTA_TEST_UNSET}"
+	cfg.Ai.Commands = map[string]Command{"review": {Provider: "azure_openai"}}
+	if err := expandConfig(cfg); err == nil || !strings.Contains(err.Error(), "ai.azure_openai.api_key") {
+		t.Errorf("expected an error naming ai.azure_openai.api_key, got %v", err)
+	}
+
+	delete(cfg.Ai.Commands, "review")
+	if err := expandConfig(cfg); err != nil {
+		t.Fatalf("expected unused providers to be expanded leniently, got %v", err)
+	}
+	if cfg.Ai.Anthropic.APIKey != "" || cfg.Ai.AzureOpenAI.APIKey != "" {
+		t.Errorf("expected the unset keys of unused providers to be empty, got %q and %q", cfg.Ai.Anthropic.APIKey, cfg.Ai.AzureOpenAI.APIKey)
+	}
+}
+
+// TestMergeConfig tests that layers override the previous ones: commands by name, other values as a whole
+func TestMergeConfig(t *testing.T) {
+	org := ConfigSource{Name: "org.yaml", Data: []byte(`
+ai:
+  provider: openai
+  fallback_providers: [vertexai, anthropic]
+  openai:
+    model: gpt-4o
+  commands:
+    - describe:
+        description: "Describe"
+        system_prompt: "Org prompt"
+    - triage:
+        system_prompt: "Triage"
+`)}
+	repo := ConfigSource{Name: "repo.yaml", Data: []byte(`
+ai:
+  provider: anthropic
+  fallback_providers: [openai]
+  anthropic:
+    model: claude-sonnet-4-5
+  commands:
+    Describe:
+      system_prompt: "Repo prompt"
+    triage: null
+`)}
+	merged, err := MergeConfig(org, repo)
+	if err != nil {
+		t.Fatalf("MergeConfig returned an error: %v", err)
+	}
+	cfg, err := LoadConfig(ConfigSource{Name: "merged", Data: merged})
+	if err != nil {
+		t.Fatalf("LoadConfig returned an error: %v", err)
+	}
+	if cfg.Ai.Provider != "anthropic" || cfg.Ai.OpenAI.Model != "gpt-4o" || cfg.Ai.Anthropic.Model != "claude-sonnet-4-5" {
+		t.Errorf("expected the provider to be overridden and the provider settings to be kept, got %+v", cfg.Ai)
+	}
+	if !slices.Equal(cfg.Ai.FallbackProviders, []string{"openai"}) {
+		t.Errorf("expected lists to be replaced, got %v", cfg.Ai.FallbackProviders)
+	}
+	describe := cfg.Ai.Commands["describe"]
+	if describe.SystemPrompt != "Repo prompt" || describe.Description != "Describe" {
+		t.Errorf("expected the commands to be merged by name, got %+v", describe)
+	}
+	if _, ok := cfg.Ai.Commands["triage"]; ok {
+		t.Error("expected null to remove the command")
+	}
+
+	if _, err := MergeConfig(ConfigSource{Name: "list.yaml", Data: []byte("- a\n")}); err == nil || !strings.Contains(err.Error(), "list.yaml") {
+		t.Errorf("expected an error naming the source, got %v", err)
+	}
+}
+
+// TestValidateConfigSources tests that a partial file is valid over the defaults, and that errors name their file
+func TestValidateConfigSources(t *testing.T) {
+	if errs := ValidateConfig(defaultConfig); len(errs) > 0 {
+		t.Errorf("expected the built-in defaults to be valid, got %v", errs)
+	}
+	partial := ConfigSource{Name: "repo.yaml", Data: []byte("ai:\n  commands:\n    describe:\n      sticky: true\n")}
+	if err := ValidateConfigSources(DefaultConfigSource(), partial); err != nil {
+		t.Errorf("expected the partial configuration to be valid, got %v", err)
+	}
+	// Built-in commands post new comments unless a layer makes them sticky
+	cfg, err := LoadConfig(DefaultConfigSource(), ConfigSource{Name: "repo.yaml", Data: []byte("ai:\n  commands:\n    describe:\n      description: Describe\n")})
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	for name, command := range cfg.Ai.Commands {
+		if command.Sticky {
+			t.Errorf("expected the built-in command %q not to be sticky", name)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		data     string
+		expected string
+	}{
+		{"Unknown key", "ai:\n  providr: anthropic\n", `repo.yaml: line 2, column 3: unknown key "providr" in ai, did you mean "provider"?`},
+		{"Incomplete command", "ai:\n  commands:\n    triage:\n      description: Triage\n", `merged configuration: command "triage" has no system_prompt`},
+		{"Missing provider settings", "ai:\n  provider: vertexai\n", "merged configuration: ai.vertexai.project is required to use the vertexai provider"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateConfigSources(DefaultConfigSource(), ConfigSource{Name: "repo.yaml", Data: []byte(tt.data)})
+			if err == nil || !strings.HasPrefix(err.Error(), tt.expected) {
+				t.Errorf("expected %q, got %v", tt.expected, err)
+			}
+		})
+	}
+}
+
+// TestRenderPrompt tests the data and functions of prompt templates
+func TestRenderPrompt(t *testing.T) {
+	data := &PromptData{
+		Issue:    PromptIssue{Title: "Disk full", Body: "The disk of db-1 is full", Labels: []string{"incident", "db"}},
+		Comments: []PromptComment{{Author: "a", Body: "first"}, {Author: "b", Body: "second"}, {Author: "c", Body: "third"}},
+		Intent:   "What next?",
+		Repo:     "owner/repo",
+	}
+	tests := []struct {
+		name     string
+		template string
+		expected string
+	}{
+		{"Plain text", "Describe the Issue.\n", "Describe the Issue.\n"},
+		{"Fields", "{{ .Repo }}: {{ .Issue.Title }} [{{ join .Issue.Labels \", \" }}]", "owner/repo: Disk full [incident, db]"},
+		{"Truncate", "{{ .Issue.Body | truncate 8 }}", "The disk…"},
+		{"Last comments", "{{ range last 2 .Comments }}{{ .Author }}:{{ .Body }} {{ end }}", "b:second c:third "},
+		{"Upper", "{{ upper .Intent }}", "WHAT NEXT?"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := RenderPrompt("test", tt.template, data)
+			if err != nil {
+				t.Fatalf("RenderPrompt returned an error: %v", err)
+			}
+			if got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+
+	if _, err := RenderPrompt("test", "{{ .Issue.Unknown }}", data); err == nil {
+		t.Error("expected an error for an unknown field")
+	}
+}
+
+// TestUsesField tests that references to a field are found anywhere in the template
+func TestUsesField(t *testing.T) {
+	tests := []struct {
+		template string
+		expected bool
+	}{
+		{"Answer: {{ .Intent }}", true},
+		{"{{ if .Issue.Title }}{{ .Intent | upper }}{{ end }}", true},
+		{"{{ with .Issue }}{{ $.Intent }}{{ end }}", true},
+		{"{{ .Issue.Title }}", false},
+		{"Answer the question", false},
+	}
+	for _, tt := range tests {
+		tmpl, err := ParsePromptTemplate("test", tt.template)
+		if err != nil {
+			t.Fatalf("ParsePromptTemplate(%q) returned an error: %v", tt.template, err)
+		}
+		if got := UsesField(tmpl, "Intent"); got != tt.expected {
+			t.Errorf("%q: expected %v, got %v", tt.template, tt.expected, got)
+		}
+	}
+}
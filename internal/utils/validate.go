@@ -0,0 +1,431 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Providers supported by ai.provider and ai.fallback_providers
+var Providers = []string{"openai", "vertexai", "anthropic", "azure_openai"}
+
+// Required settings of each provider, as keys of its section
+var requiredProviderKeys = map[string][]string{
+	"openai":       {"model"},
+	"vertexai":     {"project", "region", "model"},
+	"anthropic":    {"model"},
+	"azure_openai": {"endpoint", "deployment"},
+}
+
+// ConfigError is a problem found in a configuration file, with its position when it is known
+type ConfigError struct {
+	Line    int
+	Column  int
+	Message string
+}
+
+func (e *ConfigError) Error() string {
+	if e.Line == 0 {
+		return e.Message
+	}
+	return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, e.Message)
+}
+
+// ValidationError holds all the problems found in a configuration file
+type ValidationError struct {
+	Filename string
+	Errors   []*ConfigError
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		messages[i] = e.Filename + ": " + err.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+// ValidateConfig checks a complete YAML configuration: the checks of ValidateConfigLayer,
+// unknown providers, missing provider settings and commands without a system prompt.
+func ValidateConfig(data []byte) []*ConfigError {
+	return validateConfig(data, true)
+}
+
+// ValidateConfigLayer checks a configuration that is merged with others, see MergeConfig: keys that Config does not have,
+// values of the wrong type, duplicate keys and command names, and API keys that are not references.
+// Settings can be missing, as another layer may set them.
+func ValidateConfigLayer(data []byte) []*ConfigError {
+	return validateConfig(data, false)
+}
+
+func validateConfig(data []byte, complete bool) []*ConfigError {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return []*ConfigError{yamlError(err)}
+	}
+	v := &validator{values: make(map[string]*yaml.Node)}
+	if len(doc.Content) == 0 {
+		if !complete {
+			return nil
+		}
+		return []*ConfigError{{Message: "the configuration is empty"}}
+	}
+	v.walk(doc.Content[0], reflect.TypeOf(Config{}), "")
+	if complete {
+		v.checkProviders()
+		v.checkCommands()
+	}
+	v.checkSecrets()
+	v.checkTemplates()
+	sort.SliceStable(v.errs, func(i, j int) bool {
+		if v.errs[i].Line != v.errs[j].Line {
+			return v.errs[i].Line < v.errs[j].Line
+		}
+		return v.errs[i].Column < v.errs[j].Column
+	})
+	return v.errs
+}
+
+// yaml.v3 reports syntax errors as "yaml: line N: message"
+var yamlLineRe = regexp.MustCompile(`^yaml: line (\d+): (.*)$`)
+
+func yamlError(err error) *ConfigError {
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) {
+		return &ConfigError{Message: strings.Join(typeErr.Errors, "; ")}
+	}
+	if m := yamlLineRe.FindStringSubmatch(err.Error()); m != nil {
+		line, _ := strconv.Atoi(m[1])
+		return &ConfigError{Line: line, Column: 1, Message: m[2]}
+	}
+	return &ConfigError{Message: err.Error()}
+}
+
+type validator struct {
+	errs []*ConfigError
+	// Value nodes by dotted path, e.g. "ai.openai.model". Commands are stored as "ai.commands.<name>".
+	values map[string]*yaml.Node
+	// Command names in the order they are defined, with their key nodes
+	commands []*yaml.Node
+}
+
+func (v *validator) errorf(node *yaml.Node, format string, args ...any) {
+	err := &ConfigError{Message: fmt.Sprintf(format, args...)}
+	if node != nil {
+		err.Line, err.Column = node.Line, node.Column
+	}
+	v.errs = append(v.errs, err)
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// walk checks that node can be decoded into a value of type t
+func (v *validator) walk(node *yaml.Node, t reflect.Type, path string) {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	v.values[path] = node
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	// An empty value leaves the setting unset
+	if node.Kind == yaml.ScalarNode && node.Tag == "!!null" {
+		return
+	}
+
+	switch {
+	case t == durationType:
+		if node.Kind != yaml.ScalarNode {
+			v.errorf(node, "%s must be a duration, e.g. \"30s\"", path)
+		} else if _, err := time.ParseDuration(node.Value); err != nil {
+			if _, err := strconv.ParseInt(node.Value, 10, 64); err != nil {
+				v.errorf(node, "%s must be a duration, e.g. \"30s\", got %q", path, node.Value)
+			}
+		}
+	case t.Kind() == reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			v.errorf(node, "%s must be a mapping", path)
+			return
+		}
+		v.walkStruct(node, t, path)
+	case t.Kind() == reflect.Map:
+		v.walkMap(node, t, path)
+	case t.Kind() == reflect.Slice:
+		if node.Kind != yaml.SequenceNode {
+			v.errorf(node, "%s must be a list", path)
+			return
+		}
+		for i, item := range node.Content {
+			v.walk(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i))
+		}
+	default:
+		v.checkScalar(node, t, path)
+	}
+}
+
+func (v *validator) walkStruct(node *yaml.Node, t reflect.Type, path string) {
+	fields := make(map[string]reflect.StructField)
+	names := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ",")
+		if name == "" {
+			name = strings.ToLower(t.Field(i).Name)
+		}
+		fields[name] = t.Field(i)
+		names = append(names, name)
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		// Keys are case-insensitive, as in viper
+		name := strings.ToLower(key.Value)
+		if seen[name] {
+			v.errorf(key, "duplicate key %q in %s", key.Value, describePath(path))
+			continue
+		}
+		seen[name] = true
+		field, ok := fields[name]
+		if !ok {
+			msg := fmt.Sprintf("unknown key %q in %s", key.Value, describePath(path))
+			if suggestion := closestName(name, names); suggestion != "" {
+				msg += fmt.Sprintf(", did you mean %q?", suggestion)
+			}
+			v.errorf(key, "%s", msg)
+			continue
+		}
+		v.walk(value, field.Type, joinPath(path, name))
+	}
+}
+
+// walkMap checks a map, which can also be written as a list of mappings, e.g. the commands in the README
+func (v *validator) walkMap(node *yaml.Node, t reflect.Type, path string) {
+	var pairs []*yaml.Node
+	switch node.Kind {
+	case yaml.MappingNode:
+		pairs = node.Content
+	case yaml.SequenceNode:
+		for _, item := range node.Content {
+			if item.Kind != yaml.MappingNode {
+				v.errorf(item, "items of %s must be mappings, e.g. \"- name: ...\"", path)
+				continue
+			}
+			pairs = append(pairs, item.Content...)
+		}
+	default:
+		v.errorf(node, "%s must be a mapping", path)
+		return
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		key, value := pairs[i], pairs[i+1]
+		// viper lowercases the keys of maps too
+		name := strings.ToLower(key.Value)
+		if seen[name] {
+			if path == "ai.commands" {
+				v.errorf(key, "duplicate command %q", key.Value)
+			} else {
+				v.errorf(key, "duplicate key %q in %s", key.Value, path)
+			}
+			continue
+		}
+		seen[name] = true
+		if path == "ai.commands" {
+			v.commands = append(v.commands, key)
+		}
+		v.walk(value, t.Elem(), joinPath(path, name))
+	}
+}
+
+func (v *validator) checkScalar(node *yaml.Node, t reflect.Type, path string) {
+	if node.Kind != yaml.ScalarNode {
+		v.errorf(node, "%s must be a single value", path)
+		return
+	}
+	var err error
+	switch t.Kind() {
+	case reflect.Bool:
+		_, err = strconv.ParseBool(node.Value)
+	case reflect.Int, reflect.Int64:
+		_, err = strconv.ParseInt(node.Value, 10, 64)
+	case reflect.Float64:
+		_, err = strconv.ParseFloat(node.Value, 64)
+	}
+	if err != nil {
+		v.errorf(node, "%s must be a %s, got %q", path, t.Kind(), node.Value)
+	}
+}
+
+// value returns the scalar at path, or "" if it is not set
+func (v *validator) value(path string) string {
+	if node, ok := v.values[path]; ok && node.Kind == yaml.ScalarNode && node.Tag != "!!null" {
+		return node.Value
+	}
+	return ""
+}
+
+// checkProviders checks that the providers are known and have their required settings
+func (v *validator) checkProviders() {
+	if v.value("ai.provider") == "" {
+		v.errorf(v.values["ai"], "ai.provider is required, one of %s", strings.Join(Providers, ", "))
+	}
+	paths := []string{"ai.provider"}
+	for i := 0; v.values[fmt.Sprintf("ai.fallback_providers[%d]", i)] != nil; i++ {
+		paths = append(paths, fmt.Sprintf("ai.fallback_providers[%d]", i))
+	}
+
+	checked := make(map[string]bool)
+	for _, path := range paths {
+		provider := v.value(path)
+		if provider == "" || checked[provider] {
+			continue
+		}
+		checked[provider] = true
+		required, ok := requiredProviderKeys[provider]
+		if !ok {
+			v.errorf(v.values[path], "unknown provider %q, expected one of %s", provider, strings.Join(Providers, ", "))
+			continue
+		}
+		for _, key := range required {
+			if v.value("ai."+provider+"."+key) != "" {
+				continue
+			}
+			// Point to the provider section if there is one, or to where the provider is chosen
+			node := v.values["ai."+provider]
+			if node == nil {
+				node = v.values[path]
+			}
+			v.errorf(node, "ai.%s.%s is required to use the %s provider", provider, key, provider)
+		}
+	}
+}
+
+// checkCommands checks that there are commands, that each has a system prompt,
+// and that the provider and generation parameters of the commands are valid
+func (v *validator) checkCommands() {
+	if len(v.commands) == 0 {
+		v.errorf(v.values["ai"], "ai.commands must define at least one command")
+		return
+	}
+	for _, key := range v.commands {
+		path := "ai.commands." + strings.ToLower(key.Value)
+		if v.value(path+".system_prompt") == "" {
+			v.errorf(key, "command %q has no system_prompt", key.Value)
+		}
+		v.checkCommandProvider(path)
+		v.checkRange(path+".temperature", 0, 2)
+		v.checkRange(path+".top_p", 0, 1)
+		if n, err := strconv.Atoi(v.value(path + ".max_tokens")); err == nil && n < 0 {
+			v.errorf(v.values[path+".max_tokens"], "%s.max_tokens must not be negative", path)
+		}
+	}
+}
+
+// Settings that the model of a command replaces
+var modelKeys = map[string]string{"openai": "model", "vertexai": "model", "anthropic": "model", "azure_openai": "deployment"}
+
+// checkCommandProvider checks that the provider of a command is known and has its required settings
+func (v *validator) checkCommandProvider(path string) {
+	provider := v.value(path + ".provider")
+	if provider == "" {
+		return
+	}
+	required, ok := requiredProviderKeys[provider]
+	if !ok {
+		v.errorf(v.values[path+".provider"], "unknown provider %q, expected one of %s", provider, strings.Join(Providers, ", "))
+		return
+	}
+	for _, key := range required {
+		if v.value("ai."+provider+"."+key) != "" || (key == modelKeys[provider] && v.value(path+".model") != "") {
+			continue
+		}
+		v.errorf(v.values[path+".provider"], "ai.%s.%s is required to use the %s provider in %s", provider, key, provider, path)
+	}
+}
+
+// checkRange checks that the number at path, if set, is between low and high
+func (v *validator) checkRange(path string, low, high float64) {
+	if x, err := strconv.ParseFloat(v.value(path), 64); err == nil && (x < low || x > high) {
+		v.errorf(v.values[path], "%s must be between %g and %g, got %g", path, low, high, x)
+	}
+}
+
+// checkSecrets checks that API keys are references to the environment or a file, so that they are not committed
+func (v *validator) checkSecrets() {
+	for _, provider := range Providers {
+		path := "ai." + provider + ".api_key"
+		if key := v.value(path); key != "" && !referenceRe.MatchString(key) {
+			v.errorf(v.values[path], "%s must be a reference such as \"${ENV_VAR}\" or \"${file:/path}\", not the key itself", path)
+		}
+	}
+}
+
+// checkTemplates checks that the prompts of the commands are valid templates
+func (v *validator) checkTemplates() {
+	for _, key := range v.commands {
+		for _, field := range []string{"system_prompt", "user_template"} {
+			path := "ai.commands." + strings.ToLower(key.Value) + "." + field
+			text := v.value(path)
+			if text == "" {
+				continue
+			}
+			if _, err := ParsePromptTemplate(field, text); err != nil {
+				v.errorf(v.values[path], "%s is not a valid template: %v", path, err)
+			}
+		}
+	}
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func describePath(path string) string {
+	if path == "" {
+		return "the top level"
+	}
+	return path
+}
+
+// closestName returns the name that is at most 2 edits away from name, or "" if there is none
+func closestName(name string, names []string) string {
+	best, bestDistance := "", 3
+	for _, candidate := range names {
+		if d := editDistance(name, candidate); d < bestDistance {
+			best, bestDistance = candidate, d
+		}
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}